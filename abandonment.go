@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const ABANDON_TICK = 5 * time.Second
+
+// detachedSession is a queued session without any open SSE stream
+type detachedSession struct {
+	route string
+	since time.Time
+}
+
+type AbandonmentStats struct {
+	Queued    int     `json:"queued"`
+	Abandoned int     `json:"abandoned"`
+	Rate      float64 `json:"rate"`
+}
+
+var service_vwr_abandon_grace int
+
+var detached = make(map[string]detachedSession)
+var queuedCounts = make(map[string]int)
+var abandonedCounts = make(map[string]int)
+var livenessMutex sync.Mutex
+
+// abandonGrace returns the seconds a queued session may stay without an open
+// page, routes without their own value use the global vwr_abandon_grace
+func (route Route) abandonGrace() int {
+	if route.ABANDON_GRACE > 0 {
+		return route.ABANDON_GRACE
+	}
+	return service_vwr_abandon_grace
+}
+
+// trackQueued counts a session entering the queue of a route, its grace
+// period starts right away unless its page is already listening
+func trackQueued(name string, keyEnc string) {
+	listening := hasSubscription(name, keyEnc)
+
+	livenessMutex.Lock()
+	defer livenessMutex.Unlock()
+
+	queuedCounts[name]++
+	if !listening {
+		detached[keyEnc] = detachedSession{route: name, since: time.Now()}
+	}
+}
+
+func streamOpened(keyEnc string) {
+	livenessMutex.Lock()
+	defer livenessMutex.Unlock()
+
+	delete(detached, keyEnc)
+}
+
+// streamClosed starts the grace period of a session whose last page went
+// away while it was still waiting
+func streamClosed(name string, keyEnc string) {
+	if !isQueued(name, keyEnc) {
+		return
+	}
+
+	livenessMutex.Lock()
+	defer livenessMutex.Unlock()
+
+	detached[keyEnc] = detachedSession{route: name, since: time.Now()}
+}
+
+// sessionSeen restarts the grace period of a queued session without an open
+// page, apps polling the status API stay in the queue this way
+func sessionSeen(name string, keyEnc string) {
+	if !isQueued(name, keyEnc) || hasSubscription(name, keyEnc) {
+		return
+	}
+
+	livenessMutex.Lock()
+	defer livenessMutex.Unlock()
+
+	detached[keyEnc] = detachedSession{route: name, since: time.Now()}
+}
+
+func forgetSession(keyEnc string) {
+	livenessMutex.Lock()
+	defer livenessMutex.Unlock()
+
+	delete(detached, keyEnc)
+}
+
+// runAbandonment evicts the queued sessions that had no open page for longer
+// than the grace period of their route, the visitor enters the queue again
+// at the tail if they come back
+func runAbandonment() {
+	ticker := time.NewTicker(ABANDON_TICK)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		roomMutex.Lock()
+		now := time.Now()
+		abandoned := make(map[string]string)
+
+		livenessMutex.Lock()
+		for keyEnc, session := range detached {
+			grace := time.Duration(routes[session.route].abandonGrace()) * time.Second
+			if now.Sub(session.since) >= grace {
+				abandoned[keyEnc] = session.route
+				delete(detached, keyEnc)
+			}
+		}
+		livenessMutex.Unlock()
+
+		moved := make(map[string]bool)
+		for keyEnc, name := range abandoned {
+			if !removeFromQueue(name, keyEnc) {
+				continue
+			}
+			dropSession(name, keyEnc)
+			moved[name] = true
+
+			livenessMutex.Lock()
+			abandonedCounts[name]++
+			livenessMutex.Unlock()
+			countAbandonment(name)
+		}
+
+		for name := range moved {
+			log.Printf("evicted abandoned sessions of %s\n", name)
+			notifyPositions(name)
+			sendRouteUpdate()
+		}
+		roomMutex.Unlock()
+	}
+}
+
+func abandonmentStats(name string) AbandonmentStats {
+	livenessMutex.Lock()
+	defer livenessMutex.Unlock()
+
+	stats := AbandonmentStats{
+		Queued:    queuedCounts[name],
+		Abandoned: abandonedCounts[name],
+	}
+	if stats.Queued > 0 {
+		stats.Rate = float64(stats.Abandoned) / float64(stats.Queued)
+	}
+	return stats
+}
+
+func getAbandonment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := make(map[string]AbandonmentStats)
+	for name := range routes {
+		stats[name] = abandonmentStats(name)
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+// RouteState is the part of a route operators change at runtime, it is saved
+// to vwr_state_file so that it survives restarts
+type RouteState struct {
+	STATE  string `json:"state"`
+	CLOSED bool   `json:"closed"`
+}
+
+var service_vwr_state_file string
+
+func (route Route) state() string {
+	if route.STATE == "" {
+		return ROUTE_ACTIVE
+	}
+	return route.STATE
+}
+
+// routeClosed tells whether a route turns newcomers away, a route whose event
+// ended is closed like a sold out one
+func routeClosed(name string) bool {
+	route := routes[name]
+	return route.CLOSED || route.state() == ROUTE_DISABLED || route.eventState(time.Now()) == EVENT_ENDED
+}
+
+func loadRouteStates() {
+	data, err := os.ReadFile(service_vwr_state_file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Error reading route states:", err)
+		}
+		return
+	}
+
+	states := make(map[string]RouteState)
+	if err := json.Unmarshal(data, &states); err != nil {
+		log.Println("Error decoding route states:", err)
+		return
+	}
+
+	for name, state := range states {
+		route, exists := routes[name]
+		if !exists {
+			continue
+		}
+		route.STATE = state.STATE
+		route.CLOSED = state.CLOSED
+		routes[name] = route
+	}
+}
+
+func saveRouteStates() {
+	states := make(map[string]RouteState)
+	for name, route := range routes {
+		states[name] = RouteState{
+			STATE:  route.state(),
+			CLOSED: route.CLOSED,
+		}
+	}
+
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		log.Println("Error encoding route states:", err)
+		return
+	}
+	if err := os.WriteFile(service_vwr_state_file, data, 0644); err != nil {
+		log.Println("Error writing route states:", err)
+	}
+}
+
+func setRouteState(name string, state string) {
+	route := routes[name]
+	if event := routeStateEvent(route.state(), state); event != "" {
+		fireWebhook(event, name, map[string]interface{}{"previous": route.state(), "state": state})
+	}
+	route.STATE = state
+	routes[name] = route
+	log.Printf("route %s is %s\n", name, state)
+
+	saveRouteStates()
+	sendRouteUpdate()
+}
+
+// pauseRoute stops admissions, the queue keeps growing
+func pauseRoute(name string) bool {
+	if _, exists := routes[name]; !exists {
+		return false
+	}
+
+	setRouteState(name, ROUTE_PAUSED)
+	setRoomSlots(name, 0)
+	return true
+}
+
+// resumeRoute admits from the queue again with the slots that are not held
+// by active sessions
+func resumeRoute(name string) bool {
+	route, exists := routes[name]
+	if !exists {
+		return false
+	}
+
+	setRouteState(name, ROUTE_ACTIVE)
+	if route.admissionMode() != ADMISSION_CONCURRENCY || !routeOpen(name) {
+		return true
+	}
+	refillRoom(name, route)
+	return true
+}
+
+// drainRoute admits nobody anymore and disables the route once its active
+// sessions have expired
+func drainRoute(name string) bool {
+	if _, exists := routes[name]; !exists {
+		return false
+	}
+
+	setRouteState(name, ROUTE_DRAINING)
+	setRoomSlots(name, 0)
+	checkDrained(name)
+	return true
+}
+
+func checkDrained(name string) {
+	if routes[name].state() != ROUTE_DRAINING || sessions.CountRoute(name) > 0 {
+		return
+	}
+
+	setRouteState(name, ROUTE_DISABLED)
+	clearQueue(name)
+	notifyRoute(name, sseFrame("closed", ""))
+}
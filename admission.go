@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+)
+
+const ADMISSION_TICK = time.Second
+
+var admissionCredits = make(map[string]float64)
+
+// runAdmissions releases queued sessions of the routes in rate mode, every
+// tick a route earns vwr_admission_rate/60 admissions. Unused credit is capped
+// to a single tick (plus one admission) so an empty queue does not build up
+// a burst.
+func runAdmissions() {
+	ticker := time.NewTicker(ADMISSION_TICK)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		roomMutex.Lock()
+		for name, route := range routes {
+			if route.admissionMode() != ADMISSION_RATE || route.ADMISSION_RATE <= 0 || !routeOpen(name) {
+				delete(admissionCredits, name)
+				continue
+			}
+
+			perTick := float64(route.ADMISSION_RATE) * ADMISSION_TICK.Seconds() / 60
+			credit := admissionCredits[name] + perTick
+			if credit > perTick+1 {
+				credit = perTick + 1
+			}
+
+			for credit >= 1 && admitNext(name) {
+				credit -= 1
+			}
+			admissionCredits[name] = credit
+		}
+		roomMutex.Unlock()
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const AUTOSCALE_TICK = time.Second
+const AUTOSCALE_HISTORY = 500
+const DEFAULT_AUTOSCALE_INTERVAL = 30
+const DEFAULT_AUTOSCALE_DECREASE = 0.25
+const DEFAULT_AUTOSCALE_INCREASE = 1
+
+const SIGNAL_ERROR_RATIO = "http_err_ratio"
+
+// signals are the stick table data types the autoscaler can follow, plus
+// http_err_ratio, http_err_rate over http_req_rate
+var signals = map[string]int{
+	"conn_cur":      CONN_CUR,
+	"conn_cnt":      CONN_CNT,
+	"sess_cnt":      SESS_CNT,
+	"http_req_cnt":  HTTP_REQ_CNT,
+	"http_err_cnt":  HTTP_ERR_CNT,
+	"http_req_rate": HTTP_REQ_RATE,
+	"http_err_rate": HTTP_ERR_RATE,
+}
+
+// Autoscale adjusts the capacity of a route from a signal of the stick table
+// of its backend: above HIGH the capacity shrinks by DECREASE (a fraction),
+// below LOW it grows by INCREASE users, at most once per INTERVAL seconds
+// and always within MIN and MAX
+type Autoscale struct {
+	TABLE    string  `json:"table"`
+	KEY      string  `json:"key"`
+	SIGNAL   string  `json:"signal"`
+	HIGH     float64 `json:"high"`
+	LOW      float64 `json:"low"`
+	MIN      int     `json:"min"`
+	MAX      int     `json:"max"`
+	DECREASE float64 `json:"decrease"`
+	INCREASE int     `json:"increase"`
+	INTERVAL int     `json:"interval"`
+}
+
+// Adjustment is an entry of the audit trail of the autoscaler
+type Adjustment struct {
+	Time     time.Time `json:"time"`
+	Route    string    `json:"route"`
+	Signal   string    `json:"signal"`
+	Value    float64   `json:"value"`
+	Previous int       `json:"previous"`
+	Capacity int       `json:"capacity"`
+	Reason   string    `json:"reason"`
+}
+
+type AutoscaleStatus struct {
+	Capacity int       `json:"capacity"`
+	Signal   string    `json:"signal"`
+	Value    float64   `json:"value"`
+	Known    bool      `json:"known"`
+	Min      int       `json:"min"`
+	Max      int       `json:"max"`
+	Adjusted time.Time `json:"adjusted"`
+}
+
+var service_vwr_autoscale_log string
+
+var adjustments = make([]Adjustment, 0)
+var autoscaleStatus = make(map[string]AutoscaleStatus)
+var autoscaleMutex sync.Mutex
+
+func (autoscale Autoscale) validate() error {
+	if autoscale.TABLE == "" {
+		return errors.New("autoscale needs the stick table of the backend")
+	}
+	if _, known := signals[autoscale.SIGNAL]; !known && autoscale.SIGNAL != SIGNAL_ERROR_RATIO {
+		return fmt.Errorf("unknown autoscale signal %s", autoscale.SIGNAL)
+	}
+	if autoscale.MIN < 0 || autoscale.MAX <= 0 || autoscale.MAX < autoscale.MIN {
+		return errors.New("autoscale bounds must satisfy 0 <= min <= max and max > 0")
+	}
+	if autoscale.LOW >= autoscale.HIGH {
+		return errors.New("autoscale low must be below high")
+	}
+	if autoscale.DECREASE < 0 || autoscale.DECREASE >= 1 || autoscale.INCREASE < 0 || autoscale.INTERVAL < 0 {
+		return errors.New("autoscale decrease must be in [0, 1), increase and interval must not be negative")
+	}
+	return nil
+}
+
+func (autoscale Autoscale) interval() time.Duration {
+	if autoscale.INTERVAL > 0 {
+		return time.Duration(autoscale.INTERVAL) * time.Second
+	}
+	return DEFAULT_AUTOSCALE_INTERVAL * time.Second
+}
+
+// shrink removes DECREASE of the capacity, at least one user
+func (autoscale Autoscale) shrink(capacity int) int {
+	decrease := autoscale.DECREASE
+	if decrease <= 0 {
+		decrease = DEFAULT_AUTOSCALE_DECREASE
+	}
+	step := int(math.Ceil(float64(capacity) * decrease))
+	if step < 1 {
+		step = 1
+	}
+	return capacity - step
+}
+
+func (autoscale Autoscale) grow(capacity int) int {
+	increase := autoscale.INCREASE
+	if increase <= 0 {
+		increase = DEFAULT_AUTOSCALE_INCREASE
+	}
+	return capacity + increase
+}
+
+func (autoscale Autoscale) bound(capacity int) int {
+	if capacity < autoscale.MIN {
+		return autoscale.MIN
+	}
+	if capacity > autoscale.MAX {
+		return autoscale.MAX
+	}
+	return capacity
+}
+
+// signalValue reads a data type of an entry, rates are the highest of the
+// current and the previous period so that a new period does not read as a
+// drop
+func signalValue(values map[int][]int, dataType int) (float64, bool) {
+	value, exists := values[dataType]
+	if !exists || len(value) == 0 {
+		return 0, false
+	}
+	switch dataType {
+	case HTTP_REQ_RATE, HTTP_ERR_RATE:
+		if len(value) < 3 {
+			return 0, false
+		}
+		return math.Max(float64(value[1]), float64(value[2])), true
+	}
+	return float64(value[0]), true
+}
+
+// readSignal sums the signal over the active HAProxy peers, over every entry
+// of the table or the one of KEY
+func (autoscale Autoscale) readSignal() (float64, bool) {
+	dataTypes := []int{signals[autoscale.SIGNAL]}
+	if autoscale.SIGNAL == SIGNAL_ERROR_RATIO {
+		dataTypes = []int{HTTP_ERR_RATE, HTTP_REQ_RATE}
+	}
+
+	sums := make([]float64, len(dataTypes))
+	found := false
+	for _, peer := range activePeers() {
+		table, exists := peer.tables[autoscale.TABLE]
+		if !exists {
+			continue
+		}
+		for _, entry := range table.entries {
+			if autoscale.KEY != "" && fmt.Sprint(entry.Key) != autoscale.KEY {
+				continue
+			}
+			for i, dataType := range dataTypes {
+				if value, ok := signalValue(entry.Values, dataType); ok {
+					sums[i] += value
+					found = true
+				}
+			}
+		}
+	}
+
+	if !found {
+		return 0, false
+	}
+	if autoscale.SIGNAL == SIGNAL_ERROR_RATIO {
+		if sums[1] <= 0 {
+			return 0, true
+		}
+		return sums[0] / sums[1], true
+	}
+	return sums[0], true
+}
+
+// recordAdjustment keeps the last adjustments in memory and appends them to
+// vwr_autoscale_log when set
+func recordAdjustment(adjustment Adjustment) {
+	log.Printf("autoscale %s: capacity %d -> %d (%s %s=%g)\n", adjustment.Route, adjustment.Previous, adjustment.Capacity, adjustment.Reason, adjustment.Signal, adjustment.Value)
+
+	autoscaleMutex.Lock()
+	adjustments = append(adjustments, adjustment)
+	if len(adjustments) > AUTOSCALE_HISTORY {
+		adjustments = adjustments[len(adjustments)-AUTOSCALE_HISTORY:]
+	}
+	autoscaleMutex.Unlock()
+
+	if service_vwr_autoscale_log == "" {
+		return
+	}
+	data, _ := json.Marshal(adjustment)
+	file, err := os.OpenFile(service_vwr_autoscale_log, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("Error opening the autoscale log:", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		log.Println("Error writing the autoscale log:", err)
+	}
+}
+
+// autoscaleRoute moves the capacity of a route one step according to its
+// signal, a capacity outside of the bounds is brought back right away
+func autoscaleRoute(name string, route Route, now time.Time) {
+	autoscale := *route.AUTOSCALE
+	value, known := autoscale.readSignal()
+
+	autoscaleMutex.Lock()
+	status := autoscaleStatus[name]
+	autoscaleMutex.Unlock()
+
+	capacity := route.TOTAL_ACTIVE_USERS
+	target := autoscale.bound(capacity)
+	reason := "bounds"
+	if target == capacity && known && now.Sub(status.Adjusted) >= autoscale.interval() {
+		if value > autoscale.HIGH {
+			target, reason = autoscale.bound(autoscale.shrink(capacity)), "above high"
+		} else if value < autoscale.LOW {
+			target, reason = autoscale.bound(autoscale.grow(capacity)), "below low"
+		}
+	}
+
+	status = AutoscaleStatus{
+		Capacity: target,
+		Signal:   autoscale.SIGNAL,
+		Value:    value,
+		Known:    known,
+		Min:      autoscale.MIN,
+		Max:      autoscale.MAX,
+		Adjusted: status.Adjusted,
+	}
+	if target != capacity {
+		status.Adjusted = now
+	}
+	autoscaleMutex.Lock()
+	autoscaleStatus[name] = status
+	autoscaleMutex.Unlock()
+
+	if target == capacity {
+		return
+	}
+	route.TOTAL_ACTIVE_USERS = target
+	updateRoomTable(name, route)
+	sendRouteUpdate()
+	recordAdjustment(Adjustment{
+		Time:     now,
+		Route:    name,
+		Signal:   autoscale.SIGNAL,
+		Value:    value,
+		Previous: capacity,
+		Capacity: target,
+		Reason:   reason,
+	})
+}
+
+func runAutoscale() {
+	ticker := time.NewTicker(AUTOSCALE_TICK)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		roomMutex.Lock()
+		for name, route := range routes {
+			if route.AUTOSCALE == nil {
+				continue
+			}
+			autoscaleRoute(name, route, now)
+		}
+
+		autoscaleMutex.Lock()
+		for name := range autoscaleStatus {
+			if route, exists := routes[name]; !exists || route.AUTOSCALE == nil {
+				delete(autoscaleStatus, name)
+			}
+		}
+		autoscaleMutex.Unlock()
+		roomMutex.Unlock()
+	}
+}
+
+// getAutoscale serves GET /api/v1/autoscale, the current signal and capacity
+// of the autoscaled routes and the audit trail of the adjustments (of the
+// route parameter if given)
+func getAutoscale(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("route")
+
+	autoscaleMutex.Lock()
+	statuses := make(map[string]AutoscaleStatus)
+	for route, status := range autoscaleStatus {
+		if name == "" || route == name {
+			statuses[route] = status
+		}
+	}
+	trail := make([]Adjustment, 0)
+	for _, adjustment := range adjustments {
+		if name == "" || adjustment.Route == name {
+			trail = append(trail, adjustment)
+		}
+	}
+	autoscaleMutex.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"routes":      statuses,
+		"adjustments": trail,
+	})
+}
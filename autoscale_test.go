@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAutoscaleShrink(t *testing.T) {
+	tests := []struct {
+		decrease float64
+		capacity int
+		want     int
+	}{
+		{0.5, 100, 50},
+		{0.25, 10, 7},
+		{0, 100, 75},
+		{0.1, 3, 2},
+		{0.1, 1, 0},
+	}
+	for _, test := range tests {
+		autoscale := Autoscale{DECREASE: test.decrease}
+		if got := autoscale.shrink(test.capacity); got != test.want {
+			t.Errorf("shrink(%d) with decrease %g = %d, want %d", test.capacity, test.decrease, got, test.want)
+		}
+	}
+}
+
+func TestAutoscaleGrow(t *testing.T) {
+	tests := []struct {
+		increase int
+		capacity int
+		want     int
+	}{
+		{5, 10, 15},
+		{0, 10, 11},
+		{-3, 10, 11},
+	}
+	for _, test := range tests {
+		autoscale := Autoscale{INCREASE: test.increase}
+		if got := autoscale.grow(test.capacity); got != test.want {
+			t.Errorf("grow(%d) with increase %d = %d, want %d", test.capacity, test.increase, got, test.want)
+		}
+	}
+}
+
+func TestAutoscaleBound(t *testing.T) {
+	autoscale := Autoscale{MIN: 5, MAX: 50}
+	tests := map[int]int{
+		0:   5,
+		5:   5,
+		20:  20,
+		50:  50,
+		100: 50,
+	}
+	for capacity, want := range tests {
+		if got := autoscale.bound(capacity); got != want {
+			t.Errorf("bound(%d) = %d, want %d", capacity, got, want)
+		}
+	}
+}
+
+func backendPeer(active bool, entries map[string]Entry) *Client {
+	return &Client{
+		active: active,
+		tables: map[string]Table{
+			"backend": {entries: entries},
+		},
+	}
+}
+
+func withPeers(t *testing.T, clients ...*Client) {
+	previous := peers
+	peers = clients
+	t.Cleanup(func() {
+		peers = previous
+	})
+}
+
+func TestAutoscaleReadSignal(t *testing.T) {
+	withPeers(t,
+		backendPeer(true, map[string]Entry{
+			"a": {Key: "a", Values: map[int][]int{CONN_CUR: {4}, HTTP_REQ_RATE: {10000, 6, 8}}},
+			"b": {Key: "b", Values: map[int][]int{CONN_CUR: {6}, HTTP_REQ_RATE: {10000, 12, 2}}},
+		}),
+		backendPeer(true, map[string]Entry{
+			"a": {Key: "a", Values: map[int][]int{CONN_CUR: {10}}},
+		}),
+		backendPeer(false, map[string]Entry{
+			"a": {Key: "a", Values: map[int][]int{CONN_CUR: {1000}}},
+		}),
+	)
+
+	tests := []struct {
+		name      string
+		autoscale Autoscale
+		want      float64
+		known     bool
+	}{
+		{"sum over peers", Autoscale{TABLE: "backend", SIGNAL: "conn_cur"}, 20, true},
+		{"single key", Autoscale{TABLE: "backend", KEY: "a", SIGNAL: "conn_cur"}, 14, true},
+		{"highest period of rates", Autoscale{TABLE: "backend", SIGNAL: "http_req_rate"}, 20, true},
+		{"missing data type", Autoscale{TABLE: "backend", SIGNAL: "sess_cnt"}, 0, false},
+		{"missing table", Autoscale{TABLE: "other", SIGNAL: "conn_cur"}, 0, false},
+		{"missing key", Autoscale{TABLE: "backend", KEY: "c", SIGNAL: "conn_cur"}, 0, false},
+	}
+	for _, test := range tests {
+		value, known := test.autoscale.readSignal()
+		if value != test.want || known != test.known {
+			t.Errorf("%s: readSignal() = %g, %t, want %g, %t", test.name, value, known, test.want, test.known)
+		}
+	}
+}
+
+func TestAutoscaleErrorRatio(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries map[string]Entry
+		want    float64
+		known   bool
+	}{
+		{"ratio", map[string]Entry{
+			"a": {Key: "a", Values: map[int][]int{HTTP_ERR_RATE: {10000, 5, 0}, HTTP_REQ_RATE: {10000, 20, 10}}},
+			"b": {Key: "b", Values: map[int][]int{HTTP_ERR_RATE: {10000, 1, 3}, HTTP_REQ_RATE: {10000, 20, 5}}},
+		}, 0.2, true},
+		{"no requests", map[string]Entry{
+			"a": {Key: "a", Values: map[int][]int{HTTP_ERR_RATE: {10000, 0, 0}, HTTP_REQ_RATE: {10000, 0, 0}}},
+		}, 0, true},
+		{"not stored", map[string]Entry{
+			"a": {Key: "a", Values: map[int][]int{CONN_CUR: {3}}},
+		}, 0, false},
+	}
+	for _, test := range tests {
+		withPeers(t, backendPeer(true, test.entries))
+		autoscale := Autoscale{TABLE: "backend", SIGNAL: SIGNAL_ERROR_RATIO}
+		value, known := autoscale.readSignal()
+		if value != test.want || known != test.known {
+			t.Errorf("%s: readSignal() = %g, %t, want %g, %t", test.name, value, known, test.want, test.known)
+		}
+	}
+}
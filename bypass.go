@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// AccessRule matches a request by client network, by the exact value of a
+// header or by a cookie matching a pattern. Only one of them is set.
+type AccessRule struct {
+	CIDR    string `json:"cidr,omitempty"`
+	HEADER  string `json:"header,omitempty"`
+	VALUE   string `json:"value,omitempty"`
+	COOKIE  string `json:"cookie,omitempty"`
+	PATTERN string `json:"pattern,omitempty"`
+}
+
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+var rulePatterns = make(map[string]*regexp.Regexp)
+var rulePatternsMutex sync.Mutex
+
+func (rule AccessRule) validate() error {
+	kinds := 0
+	if rule.CIDR != "" {
+		kinds++
+		if _, _, err := net.ParseCIDR(rule.CIDR); err != nil {
+			return fmt.Errorf("invalid cidr %s", rule.CIDR)
+		}
+	}
+	if rule.HEADER != "" {
+		kinds++
+		if !headerNamePattern.MatchString(rule.HEADER) {
+			return fmt.Errorf("invalid header name %s", rule.HEADER)
+		}
+	}
+	if rule.COOKIE != "" {
+		kinds++
+		if !headerNamePattern.MatchString(rule.COOKIE) {
+			return fmt.Errorf("invalid cookie name %s", rule.COOKIE)
+		}
+		if _, err := regexp.Compile(rule.PATTERN); err != nil {
+			return fmt.Errorf("invalid cookie pattern %s", rule.PATTERN)
+		}
+	}
+	if kinds != 1 {
+		return errors.New("a rule needs exactly one of cidr, header or cookie")
+	}
+	return nil
+}
+
+func rulePattern(pattern string) *regexp.Regexp {
+	rulePatternsMutex.Lock()
+	defer rulePatternsMutex.Unlock()
+
+	compiled, exists := rulePatterns[pattern]
+	if !exists {
+		var err error
+		compiled, err = regexp.Compile(pattern)
+		if err != nil {
+			log.Printf("Error compiling pattern %s: %v\n", pattern, err)
+		}
+		rulePatterns[pattern] = compiled
+	}
+	return compiled
+}
+
+func (rule AccessRule) matches(r *http.Request, ip net.IP) bool {
+	switch {
+	case rule.CIDR != "":
+		_, network, err := net.ParseCIDR(rule.CIDR)
+		return err == nil && ip != nil && network.Contains(ip)
+	case rule.HEADER != "":
+		for _, value := range r.Header.Values(rule.HEADER) {
+			if value == rule.VALUE {
+				return true
+			}
+		}
+	case rule.COOKIE != "":
+		cookie, err := r.Cookie(rule.COOKIE)
+		pattern := rulePattern(rule.PATTERN)
+		return err == nil && pattern != nil && pattern.MatchString(cookie.Value)
+	}
+	return false
+}
+
+func matchesAny(rules []AccessRule, r *http.Request, ip net.IP) bool {
+	for _, rule := range rules {
+		if rule.matches(r, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// haproxyQuote quotes a value for the HAProxy configuration
+func haproxyQuote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return `"` + value + `"`
+}
+
+// haproxyCondition is the ACL expression matching the same requests as the
+// rule
+func (rule AccessRule) haproxyCondition() string {
+	switch {
+	case rule.CIDR != "":
+		return "src " + rule.CIDR
+	case rule.HEADER != "":
+		return fmt.Sprintf("req.hdr(%s) -m str %s", rule.HEADER, haproxyQuote(rule.VALUE))
+	case rule.COOKIE != "":
+		return fmt.Sprintf("req.cook(%s) -m reg %s", rule.COOKIE, haproxyQuote(rule.PATTERN))
+	}
+	return ""
+}
+
+// haproxyAcls declares one ACL matching any of the rules, HAProxy ORs the
+// lines of the same ACL
+func haproxyAcls(acl string, rules []AccessRule) string {
+	config := ""
+	for _, rule := range rules {
+		config += fmt.Sprintf("\tacl %s %s\n", acl, rule.haproxyCondition())
+	}
+	return config
+}
+
+// serveAccessRules applies the allow and deny rules of a route to a request
+// HAProxy sent to lineq: a denied visitor gets 403, an allowed one gets a
+// bypass slot and the waiting page reloads into the site
+func serveAccessRules(w http.ResponseWriter, r *http.Request) bool {
+	name, keyEnc := requestRoute(r)
+	route, exists := routes[name]
+	if !exists || (len(route.BYPASS) == 0 && len(route.DENY) == 0) {
+		return false
+	}
+
+	ip := clientAddress(r)
+	if matchesAny(route.DENY, r, ip) {
+		log.Printf("denied %s on %s\n", ip, name)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return true
+	}
+
+	if matchesAny(route.BYPASS, r, ip) {
+		sid := requestSid(r, name)
+		if sid == "" {
+			return false
+		}
+		log.Printf("bypass of %s for %s\n", name, ip)
+		id, _ := sessionKey(sid, name)
+		grantSlot(name, id, keyEnc)
+		serveWaitingPage(w, r)
+		return true
+	}
+	return false
+}
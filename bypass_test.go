@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// generatedConfig returns the lines of the HAProxy configuration lineq
+// writes for the routes
+func generatedConfig(t *testing.T, configured map[string]Route) []string {
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(previous)
+	})
+
+	generateHAProxyConfiguration("room", "user", configured, "127.0.0.1", "8080", "127.0.0.1", "11111", "80")
+	data, err := os.ReadFile("haproxy.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(string(data), "\n")
+}
+
+// linesInOrder reports whether all the lines appear in the configuration in
+// the given order
+func linesInOrder(config []string, lines []string) bool {
+	for _, line := range config {
+		if len(lines) > 0 && line == lines[0] {
+			lines = lines[1:]
+		}
+	}
+	return len(lines) == 0
+}
+
+func TestAccessRuleValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  AccessRule
+		valid bool
+	}{
+		{"cidr", AccessRule{CIDR: "10.0.0.0/8"}, true},
+		{"ipv6 cidr", AccessRule{CIDR: "2001:db8::/32"}, true},
+		{"header", AccessRule{HEADER: "X-Staff", VALUE: "yes"}, true},
+		{"cookie", AccessRule{COOKIE: "vip", PATTERN: "^[a-f0-9]{8}$"}, true},
+		{"no kind", AccessRule{VALUE: "yes"}, false},
+		{"two kinds", AccessRule{CIDR: "10.0.0.0/8", HEADER: "X-Staff"}, false},
+		{"bad cidr", AccessRule{CIDR: "10.0.0.0"}, false},
+		{"bad header name", AccessRule{HEADER: "X Staff"}, false},
+		{"header name with a paren", AccessRule{HEADER: "X-Staff)"}, false},
+		{"bad cookie name", AccessRule{COOKIE: "vip;", PATTERN: "."}, false},
+		{"bad cookie pattern", AccessRule{COOKIE: "vip", PATTERN: "("}, false},
+	}
+	for _, test := range tests {
+		if err := test.rule.validate(); (err == nil) != test.valid {
+			t.Errorf("%s: validate() error %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestAccessRuleMatches(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Add("X-Staff", "no")
+	request.Header.Add("X-Staff", "yes")
+	request.AddCookie(&http.Cookie{Name: "vip", Value: "0badcafe"})
+	ip := net.ParseIP("10.1.2.3")
+
+	tests := []struct {
+		name string
+		rule AccessRule
+		ip   net.IP
+		want bool
+	}{
+		{"inside cidr", AccessRule{CIDR: "10.0.0.0/8"}, ip, true},
+		{"outside cidr", AccessRule{CIDR: "192.168.0.0/16"}, ip, false},
+		{"no client address", AccessRule{CIDR: "10.0.0.0/8"}, nil, false},
+		{"header value", AccessRule{HEADER: "X-Staff", VALUE: "yes"}, ip, true},
+		{"header name case", AccessRule{HEADER: "x-staff", VALUE: "yes"}, ip, true},
+		{"header value is exact", AccessRule{HEADER: "X-Staff", VALUE: "ye"}, ip, false},
+		{"missing header", AccessRule{HEADER: "X-Press", VALUE: "yes"}, ip, false},
+		{"cookie pattern", AccessRule{COOKIE: "vip", PATTERN: "^[a-f0-9]{8}$"}, ip, true},
+		{"cookie mismatch", AccessRule{COOKIE: "vip", PATTERN: "^[0-9]+$"}, ip, false},
+		{"missing cookie", AccessRule{COOKIE: "press", PATTERN: "."}, ip, false},
+		{"broken pattern", AccessRule{COOKIE: "vip", PATTERN: "("}, ip, false},
+	}
+	for _, test := range tests {
+		if got := test.rule.matches(request, test.ip); got != test.want {
+			t.Errorf("%s: matches() = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	rules := []AccessRule{{CIDR: "192.168.0.0/16"}, {HEADER: "X-Staff", VALUE: "yes"}}
+	if !matchesAny(rules, request, ip) {
+		t.Errorf("matchesAny missed the header rule")
+	}
+	if matchesAny(rules[:1], request, ip) || matchesAny(nil, request, ip) {
+		t.Errorf("matchesAny matched without a matching rule")
+	}
+}
+
+func TestHaproxyAcls(t *testing.T) {
+	rules := []AccessRule{
+		{CIDR: "10.0.0.0/8"},
+		{HEADER: "X-Staff", VALUE: `say "yes"`},
+		{COOKIE: "vip", PATTERN: `^[a-f0-9]{8}\.ok$`},
+	}
+	want := "\tacl bypass_shop src 10.0.0.0/8\n" +
+		"\tacl bypass_shop req.hdr(X-Staff) -m str \"say \\\"yes\\\"\"\n" +
+		"\tacl bypass_shop req.cook(vip) -m reg \"^[a-f0-9]{8}\\\\.ok$\"\n"
+	if got := haproxyAcls("bypass_shop", rules); got != want {
+		t.Errorf("haproxyAcls() =\n%s\nwant\n%s", got, want)
+	}
+	if got := haproxyAcls("deny_shop", nil); got != "" {
+		t.Errorf("haproxyAcls() without rules = %q", got)
+	}
+}
+
+func TestGeneratedAccessAcls(t *testing.T) {
+	withSessionKeys(t, nil, 60)
+	config := generatedConfig(t, map[string]Route{"shop": {
+		HOST:   "shop.example.com",
+		PATH:   "/",
+		DENY:   []AccessRule{{CIDR: "203.0.113.0/24"}},
+		BYPASS: []AccessRule{{HEADER: "X-Staff", VALUE: "yes"}, {COOKIE: "vip", PATTERN: "^ok$"}},
+	}})
+
+	want := []string{
+		"\tacl deny_shop src 203.0.113.0/24",
+		"\thttp-request deny if deny_shop { var(txn.route) -m str shop }",
+		"\tacl bypass_shop req.hdr(X-Staff) -m str \"yes\"",
+		"\tacl bypass_shop req.cook(vip) -m reg \"^ok$\"",
+		"\thttp-request track-sc0 str(\"shop\") table room if { var(txn.route) -m str shop } !bypass_shop",
+		"\thttp-request track-sc1 var(txn.userkey) table user if { var(txn.route) -m str shop } !bypass_shop",
+		"\tuse_backend %[var(txn.backid)] if bypass_shop { var(txn.route) -m str shop }",
+		"\tuse_backend %[var(txn.backid)] if has_slot",
+	}
+	if !linesInOrder(config, want) {
+		t.Errorf("generated configuration\n%s\nmisses the lines\n%s", strings.Join(config, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const CHALLENGE_TTL = 5 * time.Minute
+const MAX_POW_DIFFICULTY = 32
+
+// pendingSession is a session of a route with a proof-of-work challenge that
+// HAProxy reported before it solved the challenge
+type pendingSession struct {
+	route string
+	since time.Time
+}
+
+type ChallengeSolution struct {
+	Challenge string `json:"challenge"`
+	Nonce     string `json:"nonce"`
+}
+
+// challenges are signed with a key drawn at startup, a restart only makes
+// waiting pages fetch a new one
+var challengeKey = make([]byte, 32)
+
+var unverified = make(map[string]pendingSession)
+var solved = make(map[string]time.Time)
+
+// spent holds the signatures of the solved challenges until they expire, a
+// challenge is solved only once
+var spent = make(map[string]time.Time)
+var challengesMutex sync.Mutex
+
+func initChallenges() {
+	if _, err := rand.Read(challengeKey); err != nil {
+		log.Fatal(err)
+	}
+	go runChallenges()
+}
+
+func challengeSignature(payload string) string {
+	mac := hmac.New(sha256.New, challengeKey)
+	mac.Write([]byte(payload))
+	return b64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueChallenge binds a challenge to a session of a route, the challenge is
+// base64url(route|keyEnc|difficulty|issued|salt).signature
+func issueChallenge(name string, keyEnc string) string {
+	difficulty := routes[name].POW_DIFFICULTY
+	if difficulty <= 0 {
+		return ""
+	}
+
+	salt := make([]byte, 8)
+	rand.Read(salt)
+	data := fmt.Sprintf("%s|%s|%d|%d|%s", name, keyEnc, difficulty, time.Now().Unix(), hex.EncodeToString(salt))
+	payload := b64.RawURLEncoding.EncodeToString([]byte(data))
+	return payload + "." + challengeSignature(payload)
+}
+
+func leadingZeroBits(sum []byte) int {
+	count := 0
+	for _, b := range sum {
+		if b != 0 {
+			return count + bits.LeadingZeros8(b)
+		}
+		count += 8
+	}
+	return count
+}
+
+// verifySolution checks that the challenge was issued to the session and
+// that sha256(challenge ":" nonce) starts with enough zero bits
+func verifySolution(solution ChallengeSolution, name string, keyEnc string) error {
+	parts := strings.Split(solution.Challenge, ".")
+	if len(parts) != 2 {
+		return errors.New("malformed challenge")
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(challengeSignature(parts[0]))) {
+		return errors.New("invalid challenge signature")
+	}
+
+	data, err := b64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errors.New("malformed challenge")
+	}
+	fields := strings.Split(string(data), "|")
+	if len(fields) != 5 {
+		return errors.New("malformed challenge")
+	}
+	if fields[0] != name || fields[1] != keyEnc {
+		return errors.New("challenge for another session")
+	}
+
+	difficulty, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return errors.New("malformed challenge")
+	}
+	if difficulty < routes[name].POW_DIFFICULTY {
+		return errors.New("challenge easier than the route requires")
+	}
+
+	issued, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return errors.New("malformed challenge")
+	}
+	if time.Since(time.Unix(issued, 0)) > CHALLENGE_TTL {
+		return errors.New("expired challenge")
+	}
+
+	sum := sha256.Sum256([]byte(solution.Challenge + ":" + solution.Nonce))
+	if leadingZeroBits(sum[:]) < difficulty {
+		return errors.New("wrong solution")
+	}
+
+	challengesMutex.Lock()
+	defer challengesMutex.Unlock()
+
+	if _, exists := spent[parts[1]]; exists {
+		return errors.New("challenge already solved")
+	}
+	spent[parts[1]] = time.Unix(issued, 0)
+	return nil
+}
+
+// holdForChallenge keeps a session of a route with a proof-of-work challenge
+// out of the queue until it solved its challenge, it returns false when the
+// session can enter the queue
+func holdForChallenge(name string, keyEnc string) bool {
+	if routes[name].POW_DIFFICULTY <= 0 {
+		return false
+	}
+
+	challengesMutex.Lock()
+	defer challengesMutex.Unlock()
+
+	if _, exists := solved[keyEnc]; exists {
+		delete(solved, keyEnc)
+		return false
+	}
+	unverified[keyEnc] = pendingSession{route: name, since: time.Now()}
+	return true
+}
+
+// heldForChallenge tells if a session waits for the solution of its
+// challenge before entering the queue of the route
+func heldForChallenge(name string, keyEnc string) bool {
+	challengesMutex.Lock()
+	defer challengesMutex.Unlock()
+
+	pending, exists := unverified[keyEnc]
+	return exists && pending.route == name
+}
+
+// releaseSession lets a session that solved its challenge into the queue, the
+// solution is remembered in case HAProxy did not report the session yet
+func releaseSession(name string, keyEnc string) {
+	challengesMutex.Lock()
+	pending, exists := unverified[keyEnc]
+	delete(unverified, keyEnc)
+	solved[keyEnc] = time.Now()
+	challengesMutex.Unlock()
+
+	if exists && pending.route == name && !routeClosed(name) {
+		enqueue(name, keyEnc)
+		sendRouteUpdate()
+	}
+}
+
+// runChallenges forgets the sessions that did not solve their challenge in
+// time, they enter the queue again on their next request
+func runChallenges() {
+	ticker := time.NewTicker(CHALLENGE_TTL / 5)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		roomMutex.Lock()
+		now := time.Now()
+		expired := make(map[string]string)
+
+		challengesMutex.Lock()
+		for keyEnc, pending := range unverified {
+			if now.Sub(pending.since) > CHALLENGE_TTL {
+				expired[keyEnc] = pending.route
+				delete(unverified, keyEnc)
+			}
+		}
+		for keyEnc, since := range solved {
+			if now.Sub(since) > CHALLENGE_TTL {
+				delete(solved, keyEnc)
+			}
+		}
+		for signature, issued := range spent {
+			if now.Sub(issued) > CHALLENGE_TTL {
+				delete(spent, signature)
+			}
+		}
+		challengesMutex.Unlock()
+
+		for keyEnc, name := range expired {
+			dropSession(name, keyEnc)
+		}
+		roomMutex.Unlock()
+	}
+}
+
+// handleChallenge receives the solution of the waiting page, the session is
+// identified like the queue stream
+func handleChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := queueName(r.URL.Query().Get("host"), r.URL.Query().Get("path"))
+	if name == "" {
+		http.Error(w, "Unknown route", http.StatusNotFound)
+		return
+	}
+	sid, err := sessionId(r, r.URL.Query().Get("info"), name)
+	if err != nil {
+		http.Error(w, "Invalid session", http.StatusForbidden)
+		return
+	}
+	_, keyEnc := sessionKey(sid, name)
+
+	var solution ChallengeSolution
+	if err := json.NewDecoder(r.Body).Decode(&solution); err != nil {
+		http.Error(w, "Error decoding JSON request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := verifySolution(solution, name, keyEnc); err != nil {
+		log.Printf("rejected challenge solution of %s: %v\n", name, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	releaseSession(name, keyEnc)
+	writeJSON(w, http.StatusOK, ResponseBody{
+		Status:  "success",
+		Message: "Challenge Solved",
+	})
+}
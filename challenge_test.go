@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func withChallenges(t *testing.T) {
+	previousKey, previousUnverified, previousSolved, previousSpent := challengeKey, unverified, solved, spent
+	challengeKey = []byte("test challenge key")
+	unverified = make(map[string]pendingSession)
+	solved = make(map[string]time.Time)
+	spent = make(map[string]time.Time)
+	t.Cleanup(func() {
+		challengeKey, unverified, solved, spent = previousKey, previousUnverified, previousSolved, previousSpent
+	})
+}
+
+// solveChallenge finds a nonce the way the waiting page does
+func solveChallenge(challenge string, difficulty int) ChallengeSolution {
+	for nonce := 0; ; nonce++ {
+		sum := sha256.Sum256([]byte(challenge + ":" + strconv.Itoa(nonce)))
+		if leadingZeroBits(sum[:]) >= difficulty {
+			return ChallengeSolution{Challenge: challenge, Nonce: strconv.Itoa(nonce)}
+		}
+	}
+}
+
+// signedChallenge builds a challenge issued at a given time
+func signedChallenge(name string, keyEnc string, difficulty int, issued time.Time) string {
+	data := fmt.Sprintf("%s|%s|%d|%d|%s", name, keyEnc, difficulty, issued.Unix(), "00")
+	payload := b64.RawURLEncoding.EncodeToString([]byte(data))
+	return payload + "." + challengeSignature(payload)
+}
+
+func TestVerifySolution(t *testing.T) {
+	withRoomState(t, map[string]Route{"shop": {HOST: "shop.example.com", PATH: "/", POW_DIFFICULTY: 8}})
+	withChallenges(t)
+	_, keyEnc := sessionKey("visitor", "shop")
+	_, otherEnc := sessionKey("other", "shop")
+
+	challenge := issueChallenge("shop", keyEnc)
+	solution := solveChallenge(challenge, 8)
+	if err := verifySolution(solution, "shop", keyEnc); err != nil {
+		t.Fatalf("valid solution rejected: %v", err)
+	}
+	if err := verifySolution(solution, "shop", keyEnc); err == nil {
+		t.Errorf("replayed solution accepted")
+	}
+
+	tests := []struct {
+		name     string
+		solution ChallengeSolution
+		keyEnc   string
+	}{
+		{"other session", solveChallenge(issueChallenge("shop", keyEnc), 8), otherEnc},
+		{"too low difficulty", solveChallenge(signedChallenge("shop", keyEnc, 4, time.Now()), 4), keyEnc},
+		{"expired", solveChallenge(signedChallenge("shop", keyEnc, 8, time.Now().Add(-CHALLENGE_TTL-time.Minute)), 8), keyEnc},
+		{"forged signature", ChallengeSolution{Challenge: challenge[:len(challenge)-2] + "xx", Nonce: solution.Nonce}, keyEnc},
+		{"malformed", ChallengeSolution{Challenge: "nothing", Nonce: "0"}, keyEnc},
+	}
+	for _, test := range tests {
+		if err := verifySolution(test.solution, "shop", test.keyEnc); err == nil {
+			t.Errorf("%s: solution accepted", test.name)
+		}
+	}
+
+	// a nonce that does not reach the difficulty
+	challenge = issueChallenge("shop", keyEnc)
+	for nonce := 0; ; nonce++ {
+		sum := sha256.Sum256([]byte(challenge + ":" + strconv.Itoa(nonce)))
+		if leadingZeroBits(sum[:]) < 8 {
+			if err := verifySolution(ChallengeSolution{Challenge: challenge, Nonce: strconv.Itoa(nonce)}, "shop", keyEnc); err == nil {
+				t.Errorf("wrong nonce accepted")
+			}
+			break
+		}
+	}
+}
+
+func TestChallengeHoldsSession(t *testing.T) {
+	withRoomState(t, map[string]Route{"shop": {HOST: "shop.example.com", PATH: "/", POW_DIFFICULTY: 4}})
+	withChallenges(t)
+
+	keyEnc := queueSession("shop", "visitor")
+	if queueLength("shop") != 0 {
+		t.Fatalf("a session entered the queue before solving its challenge")
+	}
+
+	releaseSession("shop", keyEnc)
+	if queuePosition("shop", keyEnc) != 1 {
+		t.Errorf("the session did not enter the queue once it solved its challenge")
+	}
+}
@@ -8,8 +8,14 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync"
 )
 
+// PEER_QUEUE_LEN is the number of messages that may wait for a peer, a peer
+// falling further behind is disconnected and synchronizes again when HAProxy
+// reconnects
+const PEER_QUEUE_LEN = 4096
+
 type Client struct {
 	active              bool
 	conn                net.Conn
@@ -21,16 +27,60 @@ type Client struct {
 	tables              map[string]Table
 	roomTable           string
 	skip                bool
+	group               *Group
+	name                string
+	out                 chan []byte
+	closed              chan struct{}
+	closeOnce           sync.Once
+}
+
+func newClient(conn net.Conn, group *Group) *Client {
+	client := &Client{
+		active: true,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		group:  group,
+		out:    make(chan []byte, PEER_QUEUE_LEN),
+		closed: make(chan struct{}),
+	}
+	go client.writeMessages()
+	return client
+}
+
+// send queues a message for the peer, it never blocks so that the room can
+// stay locked while messages are sent to every peer
+func (client *Client) send(message []byte) {
+	select {
+	case client.out <- message:
+	case <-client.closed:
+	default:
+		log.Printf("peer %s does not keep up, disconnecting it\n", client.conn.RemoteAddr())
+		client.close()
+	}
+}
+
+func (client *Client) writeMessages() {
+	for {
+		select {
+		case message := <-client.out:
+			if _, err := client.conn.Write(message); err != nil {
+				client.close()
+				return
+			}
+		case <-client.closed:
+			return
+		}
+	}
 }
 
 func (client *Client) sendHeartBeat() {
-	client.conn.Write([]byte{CLASS_CONTROL, HEARTBEAT})
+	client.send([]byte{CLASS_CONTROL, HEARTBEAT})
 	//time.Sleep(3 * time.Second)
 	//client.sendHeartBeat()
 }
 
 func (client *Client) sendStatus(remoteId string) {
-	client.conn.Write([]byte(SUCCEEDED + "\n"))
+	client.send([]byte(SUCCEEDED + "\n"))
 }
 
 func (client *Client) initConnection(mode string) {
@@ -38,7 +88,7 @@ func (client *Client) initConnection(mode string) {
 	client.roomTable = service_vwr_room_table
 	message, err := client.reader.ReadString('\n')
 	if err != nil {
-		client.conn.Close()
+		client.close()
 		return
 	}
 	log.Printf("Message incoming: %s\n", string(message))
@@ -48,30 +98,39 @@ func (client *Client) initConnection(mode string) {
 		}
 		remoteId, err := client.reader.ReadString('\n')
 		if err != nil {
-			client.conn.Close()
-			return
-		}
-		if remoteId != "lineq\n" {
-			client.conn.Write([]byte(REMOTE_ID_MISMATCH + "\n"))
-			client.conn.Close()
+			client.close()
 			return
 		}
 
 		peerInfo, _ := client.reader.ReadString('\n')
 		if matchesPattern(`.+\s+\d+\s+\d+`, peerInfo) {
+			localId := strings.Fields(peerInfo)[0]
+			client.name = localId
+			group, status := resolveGroup(client.group, strings.TrimSuffix(remoteId, "\n"), localId)
+			if group == nil {
+				log.Printf("no peer group for %s (%s)\n", localId, strings.TrimSuffix(remoteId, "\n"))
+				client.conn.Write([]byte(status + "\n"))
+				client.close()
+				return
+			}
+			// the autoscaler reads the tables of the group members
+			withRoom(func() {
+				client.tables = make(map[string]Table)
+			})
+			group.join(client)
+
 			client.sendStatus(remoteId)
 			//go client.sendHeartBeat()
-			client.tables = make(map[string]Table)
 			auto_sync := false
 			if auto_sync {
-				client.conn.Write([]byte{CLASS_CONTROL, SYNCHRONIZATION_REQUEST})
+				client.send([]byte{CLASS_CONTROL, SYNCHRONIZATION_REQUEST})
 			}
 			client.handleRequests()
 		}
 	} else {
 		client.conn.Write([]byte(PROTOCOL_ERROR + "\n"))
 	}
-	client.conn.Close()
+	client.close()
 	return
 }
 
@@ -88,7 +147,7 @@ func (client *Client) readUpdateAck() {
 		tmp := make([]byte, 512)
 		n, err := client.reader.Read(tmp)
 		if err != nil {
-			client.conn.Close()
+			client.close()
 			return
 		}
 
@@ -105,7 +164,7 @@ func (client *Client) readUpdateAck() {
 		tmp := make([]byte, 512)
 		n, err := client.reader.Read(tmp)
 		if err != nil {
-			client.conn.Close()
+			client.close()
 			return
 		}
 
@@ -139,7 +198,7 @@ func (client *Client) readEntryUpdate() {
 		tmp := make([]byte, 512)
 		n, err := client.reader.Read(tmp)
 		if err != nil {
-			client.conn.Close()
+			client.close()
 			return
 		}
 
@@ -156,7 +215,7 @@ func (client *Client) readEntryUpdate() {
 		tmp := make([]byte, 512)
 		n, err := client.reader.Read(tmp)
 		if err != nil {
-			client.conn.Close()
+			client.close()
 			return
 		}
 
@@ -170,6 +229,10 @@ func (client *Client) readEntryUpdate() {
 	updateId := binary.BigEndian.Uint32(client.buffer[client.pointer : client.pointer+4])
 	client.pointer += 4
 
+	// the whole entry is buffered, nothing below waits on the connection
+	roomMutex.Lock()
+	defer roomMutex.Unlock()
+
 	if client.skip {
 		client.skip = false
 		client.pointer += (end - client.pointer)
@@ -232,7 +295,7 @@ func (client *Client) readEntryUpdate() {
 			consumed, number, _ := decode(client.buffer[client.pointer:])
 			values[tableDefinition.DataTypes[i]] = []int{number}
 			client.pointer += consumed
-		case HTTP_REQ_RATE:
+		case HTTP_REQ_RATE, HTTP_ERR_RATE:
 			consumed, curr_tick, _ := decode(client.buffer[client.pointer:])
 			values[tableDefinition.DataTypes[i]] = append(values[tableDefinition.DataTypes[i]], curr_tick)
 			client.pointer += consumed
@@ -262,6 +325,7 @@ func (client *Client) readEntryUpdate() {
 		KeyType:  keyType,
 		KeyValue: keyValue,
 		Values:   values,
+		Origin:   peerOrigin(client),
 	}
 
 	log.Printf("update id %v\n", updateEntry.UpdateID)
@@ -272,13 +336,16 @@ func (client *Client) readEntryUpdate() {
 
 	log.Println("Pointer ", client.pointer)
 	log.Println("End ", end)
-	keyEnc := client.updateTable(updateEntry)
+	keyEnc, accepted := client.updateTable(updateEntry)
 	client.sendUpdateAck(client.lastTableDefinition, updateId)
 
-	if client.mode == "agg" || client.mode == "vwr" {
-		client.updatePeers(client.lastTableDefinition, updateEntry.KeyType, updateEntry.KeyValue, keyEnc)
+	// a rejected key is acknowledged but never reaches the other peers
+	if accepted && (client.mode == "agg" || client.mode == "vwr") {
+		if origin, relay := client.group.shouldRelay(tableDefinition.Name, keyEnc, updateEntry.Values, updateEntry.Origin); relay {
+			client.updatePeers(client.lastTableDefinition, updateEntry.KeyType, updateEntry.KeyValue, keyEnc, origin)
+		}
 	}
-	sendTableUpdate(tableDefinition.Name, keyEnc)
+	sendGroupTableUpdate(client.group, tableDefinition.Name, keyEnc)
 }
 
 func (client *Client) sendUpdateAck(tableDefinition TableDefinition, uId uint32) {
@@ -294,7 +361,7 @@ func (client *Client) sendUpdateAck(tableDefinition TableDefinition, uId uint32)
 	length := encode(len(data))
 	message = append(header, length...)
 	message = append(message, data...)
-	client.conn.Write(message)
+	client.send(message)
 }
 
 func (client *Client) readTableDefinition() {
@@ -310,7 +377,7 @@ func (client *Client) readTableDefinition() {
 		tmp := make([]byte, 512)
 		n, err := client.reader.Read(tmp)
 		if err != nil {
-			client.conn.Close()
+			client.close()
 			return
 		}
 
@@ -327,7 +394,7 @@ func (client *Client) readTableDefinition() {
 		tmp := make([]byte, 512)
 		n, err := client.reader.Read(tmp)
 		if err != nil {
-			client.conn.Close()
+			client.close()
 			return
 		}
 
@@ -432,6 +499,9 @@ func (client *Client) readTableDefinition() {
 
 	client.lastTableDefinition = tableDefinition
 
+	roomMutex.Lock()
+	defer roomMutex.Unlock()
+
 	if _, exists := client.tables[name]; !exists {
 		table := Table{
 			localUpdateId: 0,
@@ -444,7 +514,9 @@ func (client *Client) readTableDefinition() {
 	return
 }
 
-func (client *Client) updateTable(entryUpdate EntryUpdate) string {
+// updateTable stores an entry a peer sent, it returns false when the key is
+// rejected
+func (client *Client) updateTable(entryUpdate EntryUpdate) (string, bool) {
 	tableDefinition := client.lastTableDefinition
 
 	name := tableDefinition.Name
@@ -474,21 +546,25 @@ func (client *Client) updateTable(entryUpdate EntryUpdate) string {
 
 	client.tables[name] = table
 
-	if _, exists := tables[name]; !exists {
+	if _, exists := client.group.tables[name]; !exists {
 		tmp := Table{
 			localUpdateId: 0,
 			definition:    tableDefinition,
 		}
 		tmp.entries = make(map[string]Entry)
-		tables[name] = tmp
+		client.group.tables[name] = tmp
 	}
 
 	if client.mode == "agg" {
-		tables[name] = table
+		client.group.tables[name] = table
+		client.group.storeBridged(tableDefinition, keyEnc, entry)
 	} else if client.mode == "vwr" {
 		if name == service_vwr_user_table {
-			parts := strings.Split(string(key), "@")
-			domainPath := parts[1]
+			userKey, valid := readUserKey(string(key))
+			if !valid {
+				return keyEnc, false
+			}
+			domainPath := userKey.Route
 			curStat := entry.Values[GPC1][0]
 			if curStat == 1 {
 				prevEntry, exists := tables[name].entries[keyEnc]
@@ -498,22 +574,36 @@ func (client *Client) updateTable(entryUpdate EntryUpdate) string {
 					roomEnc := b64.StdEncoding.EncodeToString(roomJson)
 
 					tables[name].entries[keyEnc] = entry
-					tables[client.roomTable].entries[roomEnc].Values[GPC0][0] -= 1
-					client.updatePeers(tables[client.roomTable].definition, tables[client.roomTable].definition.KeyType, domainPath, roomEnc)
-					cache.Set(keyEnc, []byte(domainPath))
-					sendTableUpdate(client.roomTable, roomEnc)
+					if routes[domainPath].admissionMode() == ADMISSION_CONCURRENCY {
+						tables[client.roomTable].entries[roomEnc].Values[GPC0][0] -= 1
+						// the room is shared by every group, not only by the one of this peer
+						updateClients(tables[client.roomTable].definition, roomEnc, domainPath)
+						sendTableUpdate(client.roomTable, roomEnc)
+					}
+					touchSession(keyEnc, domainPath)
+					recordAdmission(domainPath)
 				} else {
-					cache.Set(keyEnc, []byte(domainPath))
+					touchSession(keyEnc, domainPath)
 				}
 			} else {
 				if _, exists := tables[name].entries[keyEnc]; !exists {
+					if routeClosed(domainPath) {
+						return keyEnc, true
+					}
+					if queueFull(domainPath) {
+						log.Printf("queue of %s is full (%d)\n", domainPath, routes[domainPath].MAX_QUEUE_LENGTH)
+						return keyEnc, true
+					}
+					if !clientAllowed(domainPath, keyEnc) {
+						return keyEnc, true
+					}
 					tables[name].entries[keyEnc] = entry
-					sortedEntries[domainPath] = append(sortedEntries[domainPath], keyEnc)
+					enqueue(domainPath, keyEnc)
 				}
 			}
 		}
 	} else if client.mode == "acc" {
-		globTable := tables[name]
+		globTable := client.group.tables[name]
 		if globTable.entries == nil {
 			globTable.entries = make(map[string]Entry)
 		}
@@ -529,7 +619,7 @@ func (client *Client) updateTable(entryUpdate EntryUpdate) string {
 				globEntry.Values[dataType] = make([]int, 0)
 			case GPT0, GPC0, CONN_CNT, CONN_CUR, SESS_CNT, HTTP_REQ_CNT, HTTP_ERR_CNT, GPC1:
 				globEntry.Values[dataType] = make([]int, 1)
-			case HTTP_REQ_RATE:
+			case HTTP_REQ_RATE, HTTP_ERR_RATE:
 				globEntry.Values[dataType] = make([]int, 3)
 			case BYTES_IN_CNT, BYTES_OUT_CNT:
 				globEntry.Values[dataType] = make([]int, 1)
@@ -538,19 +628,17 @@ func (client *Client) updateTable(entryUpdate EntryUpdate) string {
 			}
 		}
 
+		members := client.group.activeMembers()
 		for i := 0; i < len(tableDefinition.DataTypes); i++ {
-			for i := 0; i < len(peers); i++ {
-				if !peers[i].active {
-					continue
-				}
-				if locTable, exists := peers[i].tables[name]; exists {
+			for _, peer := range members {
+				if locTable, exists := peer.tables[name]; exists {
 					if locEnt, exists := locTable.entries[keyEnc]; exists {
 						dType := tableDefinition.DataTypes[i]
 						switch dType {
 						case SERVER_ID:
 						case GPT0, GPC0, CONN_CNT, CONN_CUR, SESS_CNT, HTTP_REQ_CNT, HTTP_ERR_CNT, GPC1:
 							globEntry.Values[dType][0] += locEnt.Values[dType][0]
-						case HTTP_REQ_RATE:
+						case HTTP_REQ_RATE, HTTP_ERR_RATE:
 							globEntry.Values[dType][0] += locEnt.Values[dType][0]
 							globEntry.Values[dType][1] += locEnt.Values[dType][1]
 							globEntry.Values[dType][2] += locEnt.Values[dType][2]
@@ -565,9 +653,9 @@ func (client *Client) updateTable(entryUpdate EntryUpdate) string {
 		}
 
 		globTable.entries[keyEnc] = globEntry
-		tables[name] = globTable
+		client.group.tables[name] = globTable
 	}
-	return keyEnc
+	return keyEnc, true
 }
 
 func (client *Client) createTableDefinition(tableDefinition TableDefinition) []byte {
@@ -605,11 +693,11 @@ func (client *Client) createTableDefinition(tableDefinition TableDefinition) []b
 func (client *Client) createEntryUpdate(tableDef TableDefinition, keyType int, keyValue interface{}, keyEnc string) []byte {
 	message := make([]byte, 0)
 	tableName := tableDef.Name
-	table := tables[tableName]
+	table := client.group.tables[tableName]
 	table.localUpdateId += 1
 	entry := table.entries[keyEnc]
 
-	tables[tableName] = table
+	client.group.tables[tableName] = table
 	localUpdateId := make([]byte, 4)
 	binary.BigEndian.PutUint32(localUpdateId, table.localUpdateId)
 	message = append(message, localUpdateId...)
@@ -660,7 +748,7 @@ func (client *Client) createEntryUpdate(tableDef TableDefinition, keyType int, k
 			}
 		case GPT0, GPC0, CONN_CNT, CONN_CUR, SESS_CNT, HTTP_REQ_CNT, HTTP_ERR_CNT, GPC1:
 			message = append(message, encode(entry.Values[dataType][0])...)
-		case HTTP_REQ_RATE:
+		case HTTP_REQ_RATE, HTTP_ERR_RATE:
 			cur_tick := encode(entry.Values[dataType][0])
 			log.Println(entry.Values[dataType][0])
 			message = append(message, cur_tick...)
@@ -681,18 +769,18 @@ func (client *Client) createEntryUpdate(tableDef TableDefinition, keyType int, k
 }
 
 func (client *Client) updatePeer() {
-	for key, value := range tables {
-		keyType := tables[key].definition.KeyType
-		tableDef := client.createTableDefinition(tables[key].definition)
+	for _, value := range client.group.tables {
+		keyType := value.definition.KeyType
+		tableDef := client.createTableDefinition(value.definition)
 		for keyEnc, entry := range value.entries {
 			keyValue := entry.Key
-			entryDef := client.createEntryUpdate(tables[key].definition, keyType, keyValue, keyEnc)
-			client.sendUpdate(tableDef, entryDef, true)
+			entryDef := client.createEntryUpdate(value.definition, keyType, keyValue, keyEnc)
+			client.sendUpdate(tableDef, entryDef, true, localOrigin())
 		}
 	}
 }
 
-func (client *Client) sendUpdate(tableDef []byte, entryDef []byte, local bool) {
+func (client *Client) sendUpdate(tableDef []byte, entryDef []byte, local bool, origin Origin) {
 	message := make([]byte, 0)
 
 	tableHeader := []byte{CLASS_UPDATE, STICK_TABLE_DEFINITION}
@@ -707,26 +795,33 @@ func (client *Client) sendUpdate(tableDef []byte, entryDef []byte, local bool) {
 	message = append(message, entryDef...)
 
 	if local {
-		client.conn.Write(message)
+		client.send(message)
 	} else {
-		for i := 0; i < len(peers); i++ {
-			if peers[i].active {
-				peers[i].conn.Write(message)
+		for _, peer := range client.group.relayPeers() {
+			if peer == origin.peer {
+				continue
 			}
+			peer.send(message)
 		}
 	}
 }
 
-func (client *Client) updatePeers(table TableDefinition, keyType int, keyValue interface{}, keyEnc string) {
+func (client *Client) updatePeers(table TableDefinition, keyType int, keyValue interface{}, keyEnc string, origin Origin) {
 	tableDef := client.createTableDefinition(table)
 	entryDef := client.createEntryUpdate(table, keyType, keyValue, keyEnc)
 
-	client.sendUpdate(tableDef, entryDef, false)
+	client.sendUpdate(tableDef, entryDef, false, origin)
 }
 
 func (client *Client) close() {
-	client.active = false
-	client.conn.Close()
+	client.closeOnce.Do(func() {
+		peersMutex.Lock()
+		client.active = false
+		peersMutex.Unlock()
+
+		close(client.closed)
+		client.conn.Close()
+	})
 }
 
 func (client *Client) handleRequests() {
@@ -738,7 +833,7 @@ func (client *Client) handleRequests() {
 			tmp := make([]byte, 128)
 			n, err := client.reader.Read(tmp)
 			if err != nil {
-				client.conn.Close()
+				client.close()
 				return
 			}
 			client.buffer = tmp[:n]
@@ -747,7 +842,7 @@ func (client *Client) handleRequests() {
 			tmp := make([]byte, 128)
 			n, err := client.reader.Read(tmp)
 			if err != nil {
-				client.conn.Close()
+				client.close()
 				return
 			}
 			client.buffer = append(client.buffer, tmp[:n]...)
@@ -767,12 +862,12 @@ func (client *Client) handleRequests() {
 				client.sendHeartBeat()
 			case SYNCHRONIZATION_REQUEST:
 				log.Println("synchronization request")
-				client.updatePeer()
-				client.conn.Write([]byte{CLASS_CONTROL, SYNCHRONIZATION_FINISHED})
+				withRoom(client.updatePeer)
+				client.send([]byte{CLASS_CONTROL, SYNCHRONIZATION_FINISHED})
 			case SYNCHRONIZATION_PARTIAL:
 				log.Println("synchronization partial")
 				//client.conn.Write([]byte{CLASS_CONTROL, SYNCHRONIZATION_FINISHED})
-				client.conn.Write([]byte{CLASS_CONTROL, SYNCHRONIZATION_CONFIRMED})
+				client.send([]byte{CLASS_CONTROL, SYNCHRONIZATION_CONFIRMED})
 			case SYNCHRONIZATION_CONFIRMED:
 				log.Println("synchronization confirmed")
 			}
@@ -11,6 +11,28 @@ const (
 	DEFAULT_VWR_TOTAL_USERS      = "1"
 	DEFAULT_VWR_ROOM_TABLE       = "room"
 	DEFAULT_VWR_USERS_TABLE      = "timestamps"
+	DEFAULT_REMOTE_ID            = "lineq"
+	DEFAULT_MAX_RELAY_HOPS       = 1
+	DEFAULT_SESSION_TOKEN_TTL    = 24 * 60
+	DEFAULT_ABANDON_GRACE        = 60
+)
+
+const (
+	ADMISSION_CONCURRENCY = "concurrency"
+	ADMISSION_RATE        = "rate"
+)
+
+const (
+	ROUTE_ACTIVE   = "active"
+	ROUTE_PAUSED   = "paused"
+	ROUTE_DRAINING = "draining"
+	ROUTE_DISABLED = "disabled"
+)
+
+const (
+	EVENT_OPEN    = 0
+	EVENT_PENDING = 1
+	EVENT_ENDED   = 2
 )
 
 const (
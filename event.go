@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"time"
+)
+
+const EVENT_TICK = time.Second
+
+// preQueue holds the sessions that arrived before the start of a route event,
+// they are shuffled into the head of the queue when the event starts
+var preQueue = make(map[string]*Lane)
+var eventStates = make(map[string]int)
+
+func (route Route) eventState(now time.Time) int {
+	if !route.EVENT_START.IsZero() && now.Before(route.EVENT_START) {
+		return EVENT_PENDING
+	}
+	if !route.EVENT_END.IsZero() && !now.Before(route.EVENT_END) {
+		return EVENT_ENDED
+	}
+	return EVENT_OPEN
+}
+
+func routeOpen(name string) bool {
+	route, exists := routes[name]
+	return exists && route.eventState(time.Now()) == EVENT_OPEN && !route.CLOSED && route.state() == ROUTE_ACTIVE
+}
+
+// eventCountdown returns the seconds left before the event of the route
+// starts, or false when the route is not waiting for its event
+func eventCountdown(name string) (int, bool) {
+	route, exists := routes[name]
+	if !exists || route.eventState(time.Now()) != EVENT_PENDING {
+		return 0, false
+	}
+	return int(time.Until(route.EVENT_START).Seconds()) + 1, true
+}
+
+func queueLength(name string) int {
+	length := 0
+	if waiting, exists := preQueue[name]; exists {
+		length += waiting.Len()
+	}
+	for _, queue := range routeLanes(name) {
+		length += queue.Len()
+	}
+	return length
+}
+
+// enqueue adds a waiting session to the route, before the event starts it
+// goes to the pre-queue, afterwards to the tail of the FIFO queue. Sessions
+// of routes with a proof-of-work challenge wait until they solved it.
+func enqueue(name string, keyEnc string) {
+	if holdForChallenge(name, keyEnc) {
+		return
+	}
+	trackQueued(name, keyEnc)
+	markQueued(name, keyEnc)
+	if routes[name].eventState(time.Now()) == EVENT_PENDING {
+		if _, exists := preQueue[name]; !exists {
+			preQueue[name] = newLane()
+		}
+		preQueue[name].Push(keyEnc)
+		return
+	}
+	laneQueue(name, DEFAULT_LANE).Push(keyEnc)
+}
+
+func runEvents() {
+	ticker := time.NewTicker(EVENT_TICK)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		roomMutex.Lock()
+		now := time.Now()
+		for name, route := range routes {
+			state := route.eventState(now)
+			previous, exists := eventStates[name]
+			eventStates[name] = state
+			if !exists || previous == state {
+				continue
+			}
+
+			switch state {
+			case EVENT_OPEN:
+				startEvent(name, route)
+			case EVENT_ENDED:
+				log.Printf("event of %s ended\n", name)
+				setRoomSlots(name, 0)
+				clearQueue(name)
+				notifyRoute(name, sseFrame("closed", ""))
+			}
+		}
+		roomMutex.Unlock()
+	}
+}
+
+func startEvent(name string, route Route) {
+	waiting := make([]string, 0)
+	if queue, exists := preQueue[name]; exists {
+		waiting = queue.Keys()
+	}
+	rand.Shuffle(len(waiting), func(i, j int) {
+		waiting[i], waiting[j] = waiting[j], waiting[i]
+	})
+	lane := newLane()
+	for _, keyEnc := range append(waiting, laneQueue(name, DEFAULT_LANE).Keys()...) {
+		lane.Push(keyEnc)
+	}
+	sortedEntries[name] = lane
+	delete(preQueue, name)
+	log.Printf("event of %s started with %d visitors in the pre-queue\n", name, len(waiting))
+
+	// a paused, draining or closed route keeps its visitors in the queue
+	// until it is resumed
+	if route.admissionMode() == ADMISSION_RATE || !routeOpen(name) {
+		return
+	}
+	refillRoom(name, route)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+type RemovalReason int
+
+const (
+	REMOVAL_EXPIRED RemovalReason = iota
+	REMOVAL_DELETED
+)
+
+func (reason RemovalReason) String() string {
+	switch reason {
+	case REMOVAL_EXPIRED:
+		return "expired"
+	case REMOVAL_DELETED:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type expiryItem struct {
+	key      string
+	route    string
+	deadline time.Time
+	index    int
+}
+
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*expiryItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
+
+// ExpiryScheduler keeps one deadline per session and calls onRemove when a
+// session expires or is deleted. Expire can be driven by hand with a fake
+// clock, Run drives it from real timers. Remove calls onRemove right away,
+// in the goroutine of its caller.
+type ExpiryScheduler struct {
+	mutex    sync.Mutex
+	clock    Clock
+	items    map[string]*expiryItem
+	queue    expiryHeap
+	onRemove func(key string, route string, reason RemovalReason)
+	wake     chan struct{}
+}
+
+func newExpiryScheduler(clock Clock, onRemove func(key string, route string, reason RemovalReason)) *ExpiryScheduler {
+	return &ExpiryScheduler{
+		clock:    clock,
+		items:    make(map[string]*expiryItem),
+		queue:    make(expiryHeap, 0),
+		onRemove: onRemove,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Set adds a session or pushes back the deadline of an existing one
+func (scheduler *ExpiryScheduler) Set(key string, route string, ttl time.Duration) {
+	scheduler.mutex.Lock()
+	deadline := scheduler.clock.Now().Add(ttl)
+	if item, exists := scheduler.items[key]; exists {
+		item.route = route
+		item.deadline = deadline
+		heap.Fix(&scheduler.queue, item.index)
+	} else {
+		item := &expiryItem{
+			key:      key,
+			route:    route,
+			deadline: deadline,
+		}
+		heap.Push(&scheduler.queue, item)
+		scheduler.items[key] = item
+	}
+	scheduler.mutex.Unlock()
+
+	select {
+	case scheduler.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Remove deletes a session before its deadline
+func (scheduler *ExpiryScheduler) Remove(key string) bool {
+	scheduler.mutex.Lock()
+	item, exists := scheduler.items[key]
+	if exists {
+		heap.Remove(&scheduler.queue, item.index)
+		delete(scheduler.items, key)
+	}
+	scheduler.mutex.Unlock()
+
+	if exists {
+		scheduler.onRemove(item.key, item.route, REMOVAL_DELETED)
+	}
+	return exists
+}
+
+// RemoveRoute deletes every session of a route and returns how many there were
+func (scheduler *ExpiryScheduler) RemoveRoute(route string) int {
+	scheduler.mutex.Lock()
+	keys := make([]string, 0)
+	for key, item := range scheduler.items {
+		if item.route == route {
+			keys = append(keys, key)
+		}
+	}
+	scheduler.mutex.Unlock()
+
+	removed := 0
+	for _, key := range keys {
+		if scheduler.Remove(key) {
+			removed++
+		}
+	}
+	return removed
+}
+
+func (scheduler *ExpiryScheduler) Contains(key string) bool {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	_, exists := scheduler.items[key]
+	return exists
+}
+
+// CountRoute returns the number of sessions of a route
+func (scheduler *ExpiryScheduler) CountRoute(route string) int {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	count := 0
+	for _, item := range scheduler.items {
+		if item.route == route {
+			count++
+		}
+	}
+	return count
+}
+
+func (scheduler *ExpiryScheduler) Len() int {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	return len(scheduler.items)
+}
+
+// Expire removes every session whose deadline has passed and returns how
+// many were removed
+func (scheduler *ExpiryScheduler) Expire() int {
+	scheduler.mutex.Lock()
+	now := scheduler.clock.Now()
+	expired := make([]*expiryItem, 0)
+	for len(scheduler.queue) > 0 && !scheduler.queue[0].deadline.After(now) {
+		item := heap.Pop(&scheduler.queue).(*expiryItem)
+		delete(scheduler.items, item.key)
+		expired = append(expired, item)
+	}
+	scheduler.mutex.Unlock()
+
+	for _, item := range expired {
+		scheduler.onRemove(item.key, item.route, REMOVAL_EXPIRED)
+	}
+	return len(expired)
+}
+
+func (scheduler *ExpiryScheduler) next() (time.Duration, bool) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	if len(scheduler.queue) == 0 {
+		return 0, false
+	}
+	return scheduler.queue[0].deadline.Sub(scheduler.clock.Now()), true
+}
+
+// Run expires the sessions at their deadline, holding locker while onRemove
+// runs so that it sees the same state as the callers of Set and Remove
+func (scheduler *ExpiryScheduler) Run(locker sync.Locker) {
+	timer := time.NewTimer(time.Hour)
+	for {
+		locker.Lock()
+		scheduler.Expire()
+		locker.Unlock()
+
+		wait, pending := scheduler.next()
+		if !pending {
+			wait = time.Hour
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-scheduler.wake:
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	return clock.now
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	clock.now = clock.now.Add(d)
+}
+
+type removal struct {
+	key    string
+	route  string
+	reason RemovalReason
+}
+
+// removalLog collects the removals of a scheduler, removed receives each
+// of them for the tests driving Run
+type removalLog struct {
+	mutex    sync.Mutex
+	removals []removal
+	removed  chan removal
+}
+
+func newRemovalLog() *removalLog {
+	return &removalLog{removed: make(chan removal, 16)}
+}
+
+func (log *removalLog) onRemove(key string, route string, reason RemovalReason) {
+	log.mutex.Lock()
+	log.removals = append(log.removals, removal{key, route, reason})
+	log.mutex.Unlock()
+	log.removed <- removal{key, route, reason}
+}
+
+func (log *removalLog) all() []removal {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	return append([]removal{}, log.removals...)
+}
+
+func TestExpiryOrder(t *testing.T) {
+	clock := newFakeClock()
+	removals := newRemovalLog()
+	scheduler := newExpiryScheduler(clock, removals.onRemove)
+
+	scheduler.Set("c", "shop", 3*time.Minute)
+	scheduler.Set("a", "shop", time.Minute)
+	scheduler.Set("d", "blog", 10*time.Minute)
+	scheduler.Set("b", "blog", 2*time.Minute)
+
+	if expired := scheduler.Expire(); expired != 0 {
+		t.Fatalf("expired %d sessions before any deadline", expired)
+	}
+
+	clock.Advance(time.Minute)
+	if expired := scheduler.Expire(); expired != 1 {
+		t.Fatalf("expired %d sessions at their deadline, want 1", expired)
+	}
+
+	clock.Advance(5 * time.Minute)
+	if expired := scheduler.Expire(); expired != 2 {
+		t.Fatalf("expired %d sessions, want 2", expired)
+	}
+
+	want := []removal{
+		{"a", "shop", REMOVAL_EXPIRED},
+		{"b", "blog", REMOVAL_EXPIRED},
+		{"c", "shop", REMOVAL_EXPIRED},
+	}
+	if got := removals.all(); !reflect.DeepEqual(got, want) {
+		t.Errorf("removals %v, want %v", got, want)
+	}
+	if !scheduler.Contains("d") || scheduler.Len() != 1 || scheduler.CountRoute("blog") != 1 {
+		t.Errorf("session d should be the only one left")
+	}
+}
+
+func TestExpirySetRefreshes(t *testing.T) {
+	clock := newFakeClock()
+	removals := newRemovalLog()
+	scheduler := newExpiryScheduler(clock, removals.onRemove)
+
+	scheduler.Set("a", "shop", time.Minute)
+	scheduler.Set("b", "shop", 2*time.Minute)
+	clock.Advance(50 * time.Second)
+	scheduler.Set("a", "shop", time.Minute)
+
+	clock.Advance(20 * time.Second)
+	if expired := scheduler.Expire(); expired != 0 {
+		t.Fatalf("expired %d sessions, the refresh did not push back the deadline", expired)
+	}
+
+	clock.Advance(45 * time.Second)
+	scheduler.Expire()
+	clock.Advance(10 * time.Second)
+	scheduler.Expire()
+	want := []removal{
+		{"a", "shop", REMOVAL_EXPIRED},
+		{"b", "shop", REMOVAL_EXPIRED},
+	}
+	if got := removals.all(); !reflect.DeepEqual(got, want) {
+		t.Errorf("removals %v, want %v", got, want)
+	}
+}
+
+func TestExpirySetMovesRoute(t *testing.T) {
+	clock := newFakeClock()
+	scheduler := newExpiryScheduler(clock, newRemovalLog().onRemove)
+
+	scheduler.Set("a", "shop", time.Minute)
+	scheduler.Set("a", "blog", time.Minute)
+	if scheduler.CountRoute("shop") != 0 || scheduler.CountRoute("blog") != 1 {
+		t.Errorf("counts shop=%d blog=%d, want 0 and 1", scheduler.CountRoute("shop"), scheduler.CountRoute("blog"))
+	}
+}
+
+func TestExpiryRemove(t *testing.T) {
+	clock := newFakeClock()
+	removals := newRemovalLog()
+	scheduler := newExpiryScheduler(clock, removals.onRemove)
+
+	scheduler.Set("a", "shop", time.Minute)
+	scheduler.Set("b", "shop", 2*time.Minute)
+	scheduler.Set("c", "blog", 3*time.Minute)
+
+	if !scheduler.Remove("b") {
+		t.Fatal("Remove of a session returned false")
+	}
+	if scheduler.Remove("b") || scheduler.Remove("missing") {
+		t.Fatal("Remove of an unknown session returned true")
+	}
+	if removed := scheduler.RemoveRoute("blog"); removed != 1 {
+		t.Fatalf("RemoveRoute removed %d sessions, want 1", removed)
+	}
+
+	clock.Advance(time.Hour)
+	scheduler.Expire()
+	want := []removal{
+		{"b", "shop", REMOVAL_DELETED},
+		{"c", "blog", REMOVAL_DELETED},
+		{"a", "shop", REMOVAL_EXPIRED},
+	}
+	if got := removals.all(); !reflect.DeepEqual(got, want) {
+		t.Errorf("removals %v, want %v", got, want)
+	}
+	if REMOVAL_DELETED.String() != "deleted" || REMOVAL_EXPIRED.String() != "expired" {
+		t.Errorf("reasons read %s and %s", REMOVAL_DELETED, REMOVAL_EXPIRED)
+	}
+}
+
+func TestExpiryRunWakesUp(t *testing.T) {
+	clock := newFakeClock()
+	removals := newRemovalLog()
+	scheduler := newExpiryScheduler(clock, removals.onRemove)
+	go scheduler.Run(&sync.Mutex{})
+
+	scheduler.Set("a", "shop", time.Hour)
+	clock.Advance(2 * time.Hour)
+	// Run sleeps until the deadline of a, a new session wakes it up and it
+	// finds a expired on the fake clock
+	scheduler.Set("b", "shop", time.Hour)
+
+	select {
+	case got := <-removals.removed:
+		if got != (removal{"a", "shop", REMOVAL_EXPIRED}) {
+			t.Errorf("removed %v, want a expired", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not wake up on Set")
+	}
+
+	scheduler.Set("c", "shop", 0)
+	select {
+	case got := <-removals.removed:
+		if got != (removal{"c", "shop", REMOVAL_EXPIRED}) {
+			t.Errorf("removed %v, want c expired", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not expire a session due right away")
+	}
+	if !scheduler.Contains("b") {
+		t.Error("session b expired before its deadline")
+	}
+}
@@ -3,6 +3,5 @@ module github.com/hamedetemaad/peer-aggregator
 go 1.20
 
 require (
-	github.com/allegro/bigcache/v3 v3.1.0 // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/gorilla/websocket v1.5.0
 )
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+const DEFAULT_GROUP = "default"
+
+type Group struct {
+	name      string
+	namespace string
+	config    PeerGroup
+	peers     []*Client
+	tables    map[string]Table
+}
+
+var groups = make(map[string]*Group)
+
+// peersMutex guards peers and the peers of the groups, connections are
+// accepted and join their group on their own goroutines
+var peersMutex sync.RWMutex
+
+func initGroups(mode string, peerGroups map[string]PeerGroup) {
+	if _, exists := peerGroups[DEFAULT_GROUP]; !exists {
+		groups[DEFAULT_GROUP] = newGroup(DEFAULT_GROUP, "", PeerGroup{REMOTE_ID: DEFAULT_REMOTE_ID}, tables)
+	}
+
+	for name, peerGroup := range peerGroups {
+		if peerGroup.REMOTE_ID == "" {
+			peerGroup.REMOTE_ID = DEFAULT_REMOTE_ID
+		}
+
+		// vwr mode keeps a single waiting room state, so every group shares it
+		if name == DEFAULT_GROUP || mode == "vwr" {
+			groups[name] = newGroup(name, "", peerGroup, tables)
+		} else {
+			groups[name] = newGroup(name, name, peerGroup, make(map[string]Table))
+		}
+	}
+
+	for name, group := range groups {
+		for _, bridge := range group.config.BRIDGES {
+			if _, exists := groups[bridge]; !exists {
+				log.Printf("peer group %s: unknown bridge %s\n", name, bridge)
+			}
+		}
+	}
+}
+
+func newGroup(name string, namespace string, peerGroup PeerGroup, groupTables map[string]Table) *Group {
+	return &Group{
+		name:      name,
+		namespace: namespace,
+		config:    peerGroup,
+		peers:     make([]*Client, 0),
+		tables:    groupTables,
+	}
+}
+
+// tableLabel is the name under which a table of the group is shown on the dashboard
+func (group *Group) tableLabel(tableName string) string {
+	if group.namespace == "" {
+		return tableName
+	}
+	return group.namespace + "/" + tableName
+}
+
+// resolveGroup picks the group of a peer from the names exchanged in the
+// handshake: the id HAProxy uses for lineq and the name of the HAProxy peer.
+// Peers accepted on a group listener can only join that group.
+func resolveGroup(bound *Group, remoteId string, localId string) (*Group, string) {
+	candidates := make([]*Group, 0)
+	if bound != nil {
+		candidates = append(candidates, bound)
+	} else {
+		for _, group := range groups {
+			if group.config.TCP_PORT == "" {
+				candidates = append(candidates, group)
+			}
+		}
+	}
+
+	remoteMatched := false
+	var fallback *Group
+	for _, group := range candidates {
+		if group.config.REMOTE_ID != remoteId {
+			continue
+		}
+		remoteMatched = true
+
+		if len(group.config.PEERS) == 0 {
+			fallback = group
+			continue
+		}
+
+		for _, peer := range group.config.PEERS {
+			if peer == localId {
+				return group, SUCCEEDED
+			}
+		}
+	}
+
+	if fallback != nil {
+		return fallback, SUCCEEDED
+	}
+	if remoteMatched {
+		return nil, LOCAL_ID_MISMATCH
+	}
+	return nil, REMOTE_ID_MISMATCH
+}
+
+func (group *Group) join(client *Client) {
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+
+	client.group = group
+	group.peers = append(group.peers, client)
+}
+
+func addPeer(client *Client) {
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+
+	peers = append(peers, client)
+}
+
+// activePeers returns the connected peers of every group
+func activePeers() []*Client {
+	peersMutex.RLock()
+	defer peersMutex.RUnlock()
+
+	active := make([]*Client, 0, len(peers))
+	for _, peer := range peers {
+		if peer.active {
+			active = append(active, peer)
+		}
+	}
+	return active
+}
+
+// activeMembers returns the connected peers of the group only
+func (group *Group) activeMembers() []*Client {
+	peersMutex.RLock()
+	defer peersMutex.RUnlock()
+
+	active := make([]*Client, 0, len(group.peers))
+	for _, peer := range group.peers {
+		if peer.active {
+			active = append(active, peer)
+		}
+	}
+	return active
+}
+
+// relayPeers returns the active peers of the group and of its bridged groups
+func (group *Group) relayPeers() []*Client {
+	peersMutex.RLock()
+	defer peersMutex.RUnlock()
+
+	relay := make([]*Client, 0)
+	for _, peer := range group.peers {
+		if peer.active {
+			relay = append(relay, peer)
+		}
+	}
+
+	for _, bridge := range group.config.BRIDGES {
+		bridged, exists := groups[bridge]
+		if !exists || bridged == group {
+			continue
+		}
+		for _, peer := range bridged.peers {
+			if peer.active {
+				relay = append(relay, peer)
+			}
+		}
+	}
+	return relay
+}
+
+// storeBridged copies an entry into the namespaces of the bridged groups so
+// that their peers receive it on the next synchronization request
+func (group *Group) storeBridged(tableDefinition TableDefinition, keyEnc string, entry Entry) {
+	for _, bridge := range group.config.BRIDGES {
+		bridged, exists := groups[bridge]
+		if !exists || bridged == group {
+			continue
+		}
+
+		name := tableDefinition.Name
+		table, exists := bridged.tables[name]
+		if !exists {
+			table = Table{
+				localUpdateId: 0,
+				definition:    tableDefinition,
+			}
+			table.entries = make(map[string]Entry)
+		}
+		table.entries[keyEnc] = entry
+		bridged.tables[name] = table
+	}
+}
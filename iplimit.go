@@ -0,0 +1,311 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_IPV4_PREFIX = 24
+const DEFAULT_IPV6_PREFIX = 64
+const CLIENT_PRUNE_TICK = time.Minute
+
+// clientSession is the source address of a queue session as seen on its
+// waiting page request
+type clientSession struct {
+	route   string
+	address string
+	prefix  string
+}
+
+type Offender struct {
+	Address  string `json:"address"`
+	Queued   int    `json:"queued"`
+	Rejected int    `json:"rejected"`
+}
+
+type Offenders struct {
+	Addresses []Offender `json:"addresses"`
+	Prefixes  []Offender `json:"prefixes"`
+}
+
+var trustedProxies []*net.IPNet
+var service_vwr_ipv4_prefix int
+var service_vwr_ipv6_prefix int
+
+var clientSessions = make(map[string]clientSession)
+var addressSessions = make(map[string]map[string]bool)
+var prefixSessions = make(map[string]map[string]bool)
+var rejectedAddresses = make(map[string]int)
+var rejectedPrefixes = make(map[string]int)
+var clientsMutex sync.Mutex
+
+func initTrustedProxies(proxies []string) {
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			log.Printf("Error parsing trusted proxy %s: %v\n", proxy, err)
+			continue
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	go runClientPrune()
+}
+
+// usesClientAddress tells whether a route limits or matches its visitors by
+// their address
+func (route Route) usesClientAddress() bool {
+	if route.IP_LIMIT > 0 || route.PREFIX_LIMIT > 0 {
+		return true
+	}
+	for _, rule := range append(append([]AccessRule{}, route.BYPASS...), route.DENY...) {
+		if rule.CIDR != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// warnUntrustedProxies logs a route that depends on client addresses while
+// no proxy is trusted, behind HAProxy every visitor then has its address
+func warnUntrustedProxies(name string, route Route) {
+	if len(trustedProxies) == 0 && route.usesClientAddress() {
+		log.Printf("route %s limits or matches client addresses but trusted_proxies is empty, every visitor has the address of HAProxy\n", name)
+	}
+}
+
+func trustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddress returns the source address of a request. X-Forwarded-For is
+// only read when the request comes from a trusted proxy, and is walked from
+// the right so that a client cannot forge the addresses added by proxies.
+func clientAddress(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trustedProxy(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func addressPrefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(service_vwr_ipv4_prefix, 32)).String() + "/" + strconv.Itoa(service_vwr_ipv4_prefix)
+	}
+	return ip.Mask(net.CIDRMask(service_vwr_ipv6_prefix, 128)).String() + "/" + strconv.Itoa(service_vwr_ipv6_prefix)
+}
+
+func recordClient(name string, keyEnc string, ip net.IP) {
+	if ip == nil {
+		return
+	}
+
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	if previous, exists := clientSessions[keyEnc]; exists {
+		delete(addressSessions[previous.address], keyEnc)
+		delete(prefixSessions[previous.prefix], keyEnc)
+	}
+
+	client := clientSession{route: name, address: ip.String(), prefix: addressPrefix(ip)}
+	clientSessions[keyEnc] = client
+	if _, exists := addressSessions[client.address]; !exists {
+		addressSessions[client.address] = make(map[string]bool)
+	}
+	addressSessions[client.address][keyEnc] = true
+	if _, exists := prefixSessions[client.prefix]; !exists {
+		prefixSessions[client.prefix] = make(map[string]bool)
+	}
+	prefixSessions[client.prefix][keyEnc] = true
+}
+
+// queuedFrom counts the other sessions of a route waiting from the same
+// address or prefix
+func queuedFrom(sessions map[string]bool, name string, keyEnc string) int {
+	count := 0
+	for other := range sessions {
+		if other != keyEnc && clientSessions[other].route == name && isQueued(name, other) {
+			count++
+		}
+	}
+	return count
+}
+
+// clientAllowed tells if a session may hold a place in the queue of a route
+// given the other sessions of its address and prefix, sessions of unknown
+// address are always allowed
+func clientAllowed(name string, keyEnc string) bool {
+	route := routes[name]
+	if route.IP_LIMIT <= 0 && route.PREFIX_LIMIT <= 0 {
+		return true
+	}
+
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	client, exists := clientSessions[keyEnc]
+	if !exists {
+		return true
+	}
+
+	if route.IP_LIMIT > 0 && queuedFrom(addressSessions[client.address], name, keyEnc) >= route.IP_LIMIT {
+		log.Printf("%s holds too many places in the queue of %s\n", client.address, name)
+		rejectedAddresses[client.address]++
+		return false
+	}
+	if route.PREFIX_LIMIT > 0 && queuedFrom(prefixSessions[client.prefix], name, keyEnc) >= route.PREFIX_LIMIT {
+		log.Printf("%s holds too many places in the queue of %s\n", client.prefix, name)
+		rejectedPrefixes[client.prefix]++
+		return false
+	}
+	return true
+}
+
+// serveLimitPage records the address of a visitor and turns it away when
+// its address or prefix already holds too many places in the queue, the
+// session leaves the queue if HAProxy reported it before
+func serveLimitPage(w http.ResponseWriter, r *http.Request) bool {
+	name, keyEnc := requestRoute(r)
+	route, exists := routes[name]
+	if !exists {
+		return false
+	}
+
+	recordClient(name, keyEnc, clientAddress(r))
+	if clientAllowed(name, keyEnc) {
+		return false
+	}
+
+	if removeFromQueue(name, keyEnc) {
+		dropSession(name, keyEnc)
+		notifyPositions(name)
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(route.retryAfter()))
+	renderPage(w, name, FULL_TEMPLATE, pageData(r, name, keyEnc), http.StatusTooManyRequests)
+	return true
+}
+
+// runClientPrune forgets the addresses of the sessions lineq does not know
+// anymore
+func runClientPrune() {
+	ticker := time.NewTicker(CLIENT_PRUNE_TICK)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		roomMutex.Lock()
+		clientsMutex.Lock()
+		for keyEnc, client := range clientSessions {
+			if _, exists := tables[service_vwr_user_table].entries[keyEnc]; exists {
+				continue
+			}
+			delete(clientSessions, keyEnc)
+			delete(addressSessions[client.address], keyEnc)
+			if len(addressSessions[client.address]) == 0 {
+				delete(addressSessions, client.address)
+			}
+			delete(prefixSessions[client.prefix], keyEnc)
+			if len(prefixSessions[client.prefix]) == 0 {
+				delete(prefixSessions, client.prefix)
+			}
+		}
+		clientsMutex.Unlock()
+		roomMutex.Unlock()
+	}
+}
+
+func topOffenders(sessions map[string]map[string]bool, rejected map[string]int, name string, limit int) []Offender {
+	offenders := make([]Offender, 0)
+	seen := make(map[string]bool)
+	for address, keys := range sessions {
+		queued := 0
+		for keyEnc := range keys {
+			client := clientSessions[keyEnc]
+			if (name == "" || client.route == name) && isQueued(client.route, keyEnc) {
+				queued++
+			}
+		}
+		if queued > 0 || rejected[address] > 0 {
+			offenders = append(offenders, Offender{Address: address, Queued: queued, Rejected: rejected[address]})
+		}
+		seen[address] = true
+	}
+	for address, count := range rejected {
+		if !seen[address] {
+			offenders = append(offenders, Offender{Address: address, Rejected: count})
+		}
+	}
+
+	sort.Slice(offenders, func(i, j int) bool {
+		if offenders[i].Queued != offenders[j].Queued {
+			return offenders[i].Queued > offenders[j].Queued
+		}
+		if offenders[i].Rejected != offenders[j].Rejected {
+			return offenders[i].Rejected > offenders[j].Rejected
+		}
+		return offenders[i].Address < offenders[j].Address
+	})
+	if len(offenders) > limit {
+		offenders = offenders[:limit]
+	}
+	return offenders
+}
+
+// getOffenders serves GET /api/v1/offenders, the addresses and prefixes with
+// the most queued sessions (of the route parameter if given) and rejections
+func getOffenders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 10
+	}
+	name := r.URL.Query().Get("route")
+
+	clientsMutex.Lock()
+	offenders := Offenders{
+		Addresses: topOffenders(addressSessions, rejectedAddresses, name, limit),
+		Prefixes:  topOffenders(prefixSessions, rejectedPrefixes, name, limit),
+	}
+	clientsMutex.Unlock()
+
+	writeJSON(w, http.StatusOK, offenders)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func withTrustedProxies(t *testing.T, proxies []string) {
+	previous := trustedProxies
+	trustedProxies = nil
+	for _, proxy := range proxies {
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	t.Cleanup(func() {
+		trustedProxies = previous
+	})
+}
+
+func TestClientAddress(t *testing.T) {
+	withTrustedProxies(t, []string{"127.0.0.1/32", "10.0.0.0/8"})
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"direct client", "203.0.113.5:4000", nil, "203.0.113.5"},
+		{"untrusted client spoofing", "203.0.113.5:4000", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"trusted proxy", "127.0.0.1:4000", []string{"203.0.113.5"}, "203.0.113.5"},
+		{"trusted proxy without header", "127.0.0.1:4000", nil, "127.0.0.1"},
+		{"spoofed leftmost address", "127.0.0.1:4000", []string{"198.51.100.1, 203.0.113.5"}, "203.0.113.5"},
+		{"multi hop", "127.0.0.1:4000", []string{"203.0.113.5, 10.0.0.2"}, "203.0.113.5"},
+		{"untrusted hop", "127.0.0.1:4000", []string{"198.51.100.1, 203.0.113.5, 10.0.0.2"}, "203.0.113.5"},
+		{"header lines", "127.0.0.1:4000", []string{"198.51.100.1", "203.0.113.5, 10.0.0.2"}, "203.0.113.5"},
+		{"spoofed proxy address", "127.0.0.1:4000", []string{"10.0.0.9, 203.0.113.5"}, "203.0.113.5"},
+		{"malformed hop", "127.0.0.1:4000", []string{"203.0.113.5, junk, 10.0.0.2"}, "10.0.0.2"},
+		{"ipv6 client", "[2001:db8::1]:4000", []string{"203.0.113.5"}, "2001:db8::1"},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.RemoteAddr = test.remote
+		for _, value := range test.forwarded {
+			request.Header.Add("X-Forwarded-For", value)
+		}
+
+		if got := clientAddress(request); got.String() != test.want {
+			t.Errorf("%s: address %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestUsesClientAddress(t *testing.T) {
+	tests := []struct {
+		route Route
+		want  bool
+	}{
+		{Route{}, false},
+		{Route{IP_LIMIT: 3}, true},
+		{Route{PREFIX_LIMIT: 20}, true},
+		{Route{BYPASS: []AccessRule{{HEADER: "X-Staff", VALUE: "1"}}}, false},
+		{Route{DENY: []AccessRule{{CIDR: "192.0.2.0/24"}}}, true},
+	}
+	for _, test := range tests {
+		if got := test.route.usesClientAddress(); got != test.want {
+			t.Errorf("usesClientAddress(%+v) = %v, want %v", test.route, got, test.want)
+		}
+	}
+}
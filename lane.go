@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math"
+)
+
+const DEFAULT_LANE = "default"
+
+// sortedEntries is the default lane of every route, priorityLanes holds the
+// other lanes. Lanes are served with smooth weighted round robin.
+var priorityLanes = make(map[string]map[string]*Lane)
+var laneCurrent = make(map[string]map[string]int)
+
+// laneWeight is the share of admissions of a lane, the default lane and the
+// lanes removed from the route while sessions still wait in them weigh 1
+func (route Route) laneWeight(lane string) int {
+	if weight, exists := route.LANES[lane]; exists && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+func (route Route) hasLane(lane string) bool {
+	_, exists := route.LANES[lane]
+	return exists || lane == DEFAULT_LANE
+}
+
+// laneQueue returns a lane of a route, creating it when needed
+func laneQueue(name string, lane string) *Lane {
+	if lane == DEFAULT_LANE {
+		if _, exists := sortedEntries[name]; !exists {
+			sortedEntries[name] = newLane()
+		}
+		return sortedEntries[name]
+	}
+
+	if _, exists := priorityLanes[name]; !exists {
+		priorityLanes[name] = make(map[string]*Lane)
+	}
+	if _, exists := priorityLanes[name][lane]; !exists {
+		priorityLanes[name][lane] = newLane()
+	}
+	return priorityLanes[name][lane]
+}
+
+func routeLanes(name string) map[string]*Lane {
+	lanes := make(map[string]*Lane)
+	lanes[DEFAULT_LANE] = laneQueue(name, DEFAULT_LANE)
+	for lane, queue := range priorityLanes[name] {
+		lanes[lane] = queue
+	}
+	return lanes
+}
+
+func resetLanes(name string) {
+	sortedEntries[name] = newLane()
+	delete(priorityLanes, name)
+	delete(laneCurrent, name)
+}
+
+// popLane removes the next session to admit from the lanes of a route
+func popLane(name string) (string, bool) {
+	route := routes[name]
+	if _, exists := laneCurrent[name]; !exists {
+		laneCurrent[name] = make(map[string]int)
+	}
+	current := laneCurrent[name]
+
+	total := 0
+	best := ""
+	for lane, queue := range routeLanes(name) {
+		if queue.Len() == 0 {
+			continue
+		}
+
+		weight := route.laneWeight(lane)
+		current[lane] += weight
+		total += weight
+		if best == "" || current[lane] > current[best] {
+			best = lane
+		}
+	}
+
+	if best == "" {
+		return "", false
+	}
+	current[best] -= total
+
+	return laneQueue(name, best).Pop()
+}
+
+// removeFromQueue takes a session out of the lanes or the pre-queue of a route
+func removeFromQueue(name string, keyEnc string) bool {
+	for _, queue := range routeLanes(name) {
+		if queue.Remove(keyEnc) {
+			return true
+		}
+	}
+
+	if waiting, exists := preQueue[name]; exists {
+		return waiting.Remove(keyEnc)
+	}
+	return false
+}
+
+// moveToLane puts a waiting session at the tail of another lane, a session
+// already in that lane keeps its place
+func moveToLane(name string, keyEnc string, lane string) bool {
+	if laneQueue(name, lane).Position(keyEnc) > 0 {
+		return true
+	}
+	if !removeFromQueue(name, keyEnc) {
+		return false
+	}
+	laneQueue(name, lane).Push(keyEnc)
+	return true
+}
+
+// queuePosition estimates the 1-based position of a session given the lane
+// weights, it returns 0 when the session is not waiting
+func queuePosition(name string, keyEnc string) int {
+	route := routes[name]
+	lanes := routeLanes(name)
+
+	for lane, queue := range lanes {
+		index := queue.Position(keyEnc)
+		if index == 0 {
+			continue
+		}
+
+		weight := float64(route.laneWeight(lane))
+		position := index
+		for other, otherQueue := range lanes {
+			if other == lane {
+				continue
+			}
+			ahead := int(math.Ceil(float64(index) * float64(route.laneWeight(other)) / weight))
+			if ahead > otherQueue.Len() {
+				ahead = otherQueue.Len()
+			}
+			position += ahead
+		}
+		return position
+	}
+	return 0
+}
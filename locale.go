@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const DEFAULT_LOCALE = "en"
+
+// catalogs maps a language tag to its messages, the embedded catalogs are
+// extended key by key with the ones of vwr_locales
+var catalogs = make(map[string]map[string]string)
+
+// Localizer resolves a message from the first catalog of its chain that has
+// it: the language of the visitor, the route default, then DEFAULT_LOCALE
+type Localizer struct {
+	Lang  string
+	chain []map[string]string
+}
+
+func (route Route) locale() string {
+	if route.LOCALE != "" {
+		return strings.ToLower(route.LOCALE)
+	}
+	return DEFAULT_LOCALE
+}
+
+func initCatalogs(configured map[string]map[string]string) {
+	entries, err := embeddedStatic.ReadDir("static/locales")
+	if err != nil {
+		log.Println("Error reading embedded catalogs:", err)
+	}
+	for _, entry := range entries {
+		data, err := embeddedStatic.ReadFile("static/locales/" + entry.Name())
+		if err != nil {
+			log.Println("Error reading catalog:", err)
+			continue
+		}
+
+		messages := make(map[string]string)
+		if err := json.Unmarshal(data, &messages); err != nil {
+			log.Printf("Error decoding catalog %s: %v\n", entry.Name(), err)
+			continue
+		}
+		catalogs[strings.TrimSuffix(entry.Name(), path.Ext(entry.Name()))] = messages
+	}
+
+	for lang, messages := range configured {
+		lang = strings.ToLower(lang)
+		if _, exists := catalogs[lang]; !exists {
+			catalogs[lang] = make(map[string]string)
+		}
+		for key, message := range messages {
+			catalogs[lang][key] = message
+		}
+	}
+}
+
+// acceptedLanguages returns the tags of an Accept-Language header ordered by
+// preference, a regional tag is followed by its base language
+func acceptedLanguages(header string) []string {
+	type weightedTag struct {
+		tag    string
+		weight float64
+	}
+
+	tags := make([]weightedTag, 0)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		weight := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					weight = q
+				}
+			}
+		}
+		if weight > 0 {
+			tags = append(tags, weightedTag{tag: tag, weight: weight})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].weight > tags[j].weight
+	})
+
+	languages := make([]string, 0)
+	for _, weighted := range tags {
+		languages = append(languages, weighted.tag)
+		if base, _, regional := strings.Cut(weighted.tag, "-"); regional {
+			languages = append(languages, base)
+		}
+	}
+	return languages
+}
+
+// newLocalizer picks the catalog of a visitor from Accept-Language, falling
+// back to the default language of the route and then to DEFAULT_LOCALE
+func newLocalizer(acceptLanguage string, name string) Localizer {
+	localizer := Localizer{}
+	seen := make(map[string]bool)
+
+	candidates := append(acceptedLanguages(acceptLanguage), routes[name].locale(), DEFAULT_LOCALE)
+	for _, lang := range candidates {
+		messages, exists := catalogs[lang]
+		if !exists || seen[lang] {
+			continue
+		}
+		if localizer.Lang == "" {
+			localizer.Lang = lang
+		}
+		seen[lang] = true
+		localizer.chain = append(localizer.chain, messages)
+	}
+
+	if localizer.Lang == "" {
+		localizer.Lang = DEFAULT_LOCALE
+	}
+	return localizer
+}
+
+// T returns a message of the catalog, formatted with the given arguments,
+// a key missing from every catalog is returned as is
+func (localizer Localizer) T(key string, args ...interface{}) string {
+	for _, messages := range localizer.chain {
+		if message, exists := messages[key]; exists {
+			if len(args) > 0 {
+				return fmt.Sprintf(message, args...)
+			}
+			return message
+		}
+	}
+	return key
+}
+
+func requestLocalizer(r *http.Request, name string) Localizer {
+	return newLocalizer(r.Header.Get("Accept-Language"), name)
+}
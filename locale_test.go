@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func withCatalogs(t *testing.T, configured map[string]map[string]string, configuredRoutes map[string]Route) {
+	previousCatalogs, previousRoutes := catalogs, routes
+	catalogs, routes = configured, configuredRoutes
+	t.Cleanup(func() {
+		catalogs, routes = previousCatalogs, previousRoutes
+	})
+}
+
+func TestAcceptedLanguages(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", []string{}},
+		{"fr", []string{"fr"}},
+		{"de-CH", []string{"de-ch", "de"}},
+		{"fr;q=0.5, de;q=0.9, en", []string{"en", "de", "fr"}},
+		{"pt-BR, es;q=0.8", []string{"pt-br", "pt", "es"}},
+		{"en;q=0, fr", []string{"fr"}},
+		{"*, de;q=0.1", []string{"de"}},
+		{"it;q=abc", []string{"it"}},
+		{"fr, de", []string{"fr", "de"}},
+	}
+	for _, test := range tests {
+		if got := acceptedLanguages(test.header); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("acceptedLanguages(%q) = %v, want %v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestNewLocalizer(t *testing.T) {
+	withCatalogs(t, map[string]map[string]string{
+		"en": {"title": "Waiting room", "position": "You are number %d", "footer": "Thanks"},
+		"de": {"title": "Warteraum", "position": "Sie sind Nummer %d"},
+		"fr": {"title": "Salle d'attente"},
+	}, map[string]Route{
+		"shop":  {LOCALE: "DE"},
+		"plain": {},
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		route  string
+		lang   string
+		key    string
+		args   []interface{}
+		want   string
+	}{
+		{"exact language", "fr", "plain", "fr", "title", nil, "Salle d'attente"},
+		{"regional tag falls back to its base", "de-AT", "plain", "de", "title", nil, "Warteraum"},
+		{"q-weights", "fr;q=0.3, de;q=0.8", "plain", "de", "title", nil, "Warteraum"},
+		{"route default locale", "es", "shop", "de", "title", nil, "Warteraum"},
+		{"DEFAULT_LOCALE", "es", "plain", DEFAULT_LOCALE, "title", nil, "Waiting room"},
+		{"unknown route", "", "missing", DEFAULT_LOCALE, "title", nil, "Waiting room"},
+		{"missing key falls back along the chain", "fr", "shop", "fr", "position", []interface{}{3}, "Sie sind Nummer 3"},
+		{"missing key falls back to DEFAULT_LOCALE", "fr", "shop", "fr", "footer", nil, "Thanks"},
+		{"key missing from every catalog", "de", "shop", "de", "unknown.key", nil, "unknown.key"},
+	}
+	for _, test := range tests {
+		localizer := newLocalizer(test.header, test.route)
+		if localizer.Lang != test.lang {
+			t.Errorf("%s: Lang = %q, want %q", test.name, localizer.Lang, test.lang)
+		}
+		if got := localizer.T(test.key, test.args...); got != test.want {
+			t.Errorf("%s: T(%q) = %q, want %q", test.name, test.key, got, test.want)
+		}
+	}
+}
+
+func TestNewLocalizerWithoutCatalogs(t *testing.T) {
+	withCatalogs(t, map[string]map[string]string{}, map[string]Route{})
+
+	localizer := newLocalizer("fr", "shop")
+	if localizer.Lang != DEFAULT_LOCALE {
+		t.Errorf("Lang = %q, want %q", localizer.Lang, DEFAULT_LOCALE)
+	}
+	if got := localizer.T("title"); got != "title" {
+		t.Errorf("T(title) = %q, want the key", got)
+	}
+}
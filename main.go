@@ -1,20 +1,20 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"reflect"
+	"time"
 
 	b64 "encoding/base64"
 	"encoding/json"
 )
 
 var peers []*Client
-var sortedEntries map[string][]string = make(map[string][]string)
+var sortedEntries map[string]*Lane = make(map[string]*Lane)
 var tables = make(map[string]Table)
 var routes = make(map[string]Route)
 var service_vwr_room_table string
@@ -22,22 +22,93 @@ var service_vwr_user_table string
 var service_vwr_session_duration int
 
 type Config struct {
-	TCP_HOST         string           `json:"tcp_host" default:"localhost"`
-	WEB_HOST         string           `json:"web_host" default:"localhost"`
-	TCP_PORT         string           `json:"tcp_port" default:"11111"`
-	WEB_PORT         string           `json:"web_port" default:"8060"`
-	TARGET_PORT      string           `json:"target_port" default:"80"`
-	SERVICE_MODE     string           `json:"service_mode" default:"agg"`
-	SESSION_DURATION int              `json:"vwr_session_duration"`
-	VWR_ROOM_TABLE   string           `json:"vwr_room_table" default:"room"`
-	VWR_USER_TABLE   string           `json:"vwr_user_table" default:"user"`
-	VWR_ROUTES       map[string]Route `json:"routes"`
+	NAME              string                       `json:"name" default:"aggr1"`
+	TCP_HOST          string                       `json:"tcp_host" default:"localhost"`
+	WEB_HOST          string                       `json:"web_host" default:"localhost"`
+	TCP_PORT          string                       `json:"tcp_port" default:"11111"`
+	WEB_PORT          string                       `json:"web_port" default:"8060"`
+	TARGET_PORT       string                       `json:"target_port" default:"80"`
+	SERVICE_MODE      string                       `json:"service_mode" default:"agg"`
+	SESSION_DURATION  int                          `json:"vwr_session_duration"`
+	VWR_ROOM_TABLE    string                       `json:"vwr_room_table" default:"room"`
+	VWR_USER_TABLE    string                       `json:"vwr_user_table" default:"user"`
+	VWR_ROUTES        map[string]Route             `json:"routes"`
+	PEER_GROUPS       map[string]PeerGroup         `json:"peer_groups"`
+	MAX_RELAY_HOPS    int                          `json:"max_relay_hops"`
+	VWR_TOKEN_SECRET  string                       `json:"vwr_token_secret"`
+	VWR_SESSION_KEYS  []SessionKey                 `json:"vwr_session_keys"`
+	VWR_SESSION_TTL   int                          `json:"vwr_session_token_ttl"`
+	VWR_STATE_FILE    string                       `json:"vwr_state_file" default:"lineq.state"`
+	VWR_ABANDON_GRACE int                          `json:"vwr_abandon_grace"`
+	VWR_TEMPLATE_DIR  string                       `json:"vwr_template_dir"`
+	VWR_LOCALES       map[string]map[string]string `json:"vwr_locales"`
+	TRUSTED_PROXIES   []string                     `json:"trusted_proxies"`
+	VWR_IPV4_PREFIX   int                          `json:"vwr_ipv4_prefix"`
+	VWR_IPV6_PREFIX   int                          `json:"vwr_ipv6_prefix"`
+	VWR_WEBHOOKS      []Webhook                    `json:"vwr_webhooks"`
+	VWR_AUTOSCALE_LOG string                       `json:"vwr_autoscale_log"`
 }
 
 type Route struct {
-	TOTAL_ACTIVE_USERS int    `json:"vwr_active_users"`
-	PATH               string `json:"path"`
-	HOST               string `json:"host"`
+	TOTAL_ACTIVE_USERS int            `json:"vwr_active_users"`
+	SESSION_DURATION   int            `json:"vwr_session_duration"`
+	MAX_QUEUE_LENGTH   int            `json:"vwr_max_queue_length"`
+	ADMISSION_MODE     string         `json:"vwr_admission_mode"`
+	ADMISSION_RATE     int            `json:"vwr_admission_rate"`
+	EVENT_START        time.Time      `json:"vwr_event_start"`
+	EVENT_END          time.Time      `json:"vwr_event_end"`
+	LANES              map[string]int `json:"vwr_lanes"`
+	CLOSED             bool           `json:"vwr_closed"`
+	STATE              string         `json:"vwr_state"`
+	FULL_PAGE          string         `json:"vwr_full_page"`
+	RETRY_AFTER        int            `json:"vwr_retry_after"`
+	ABANDON_GRACE      int            `json:"vwr_abandon_grace"`
+	TEMPLATE           string         `json:"vwr_template"`
+	LOCALE             string         `json:"vwr_locale"`
+	REDIRECT           string         `json:"vwr_redirect"`
+	POW_DIFFICULTY     int            `json:"vwr_pow_difficulty"`
+	IP_LIMIT           int            `json:"vwr_ip_limit"`
+	PREFIX_LIMIT       int            `json:"vwr_prefix_limit"`
+	QUEUE_THRESHOLD    int            `json:"vwr_queue_threshold"`
+	AUTOSCALE          *Autoscale     `json:"vwr_autoscale"`
+	BYPASS             []AccessRule   `json:"vwr_bypass"`
+	DENY               []AccessRule   `json:"vwr_deny"`
+	MATCH              string         `json:"match"`
+	PATH               string         `json:"path"`
+	HOST               string         `json:"host"`
+}
+
+// sessionDuration returns the idle timeout of the route in minutes, routes
+// without their own value use the global vwr_session_duration
+func (route Route) sessionDuration() int {
+	if route.SESSION_DURATION > 0 {
+		return route.SESSION_DURATION
+	}
+	return service_vwr_session_duration
+}
+
+func (route Route) admissionMode() string {
+	if route.ADMISSION_MODE == ADMISSION_RATE {
+		return ADMISSION_RATE
+	}
+	return ADMISSION_CONCURRENCY
+}
+
+// roomSlots is the initial gpc0 of the route in the room table, rate mode,
+// closed or paused routes and routes outside of their event window keep it
+// at zero so that HAProxy never admits on its own
+func (route Route) roomSlots() int {
+	if route.admissionMode() == ADMISSION_RATE || route.eventState(time.Now()) != EVENT_OPEN || route.CLOSED || route.state() != ROUTE_ACTIVE {
+		return 0
+	}
+	return route.TOTAL_ACTIVE_USERS
+}
+
+type PeerGroup struct {
+	REMOTE_ID string   `json:"remote_id"`
+	TCP_PORT  string   `json:"tcp_port"`
+	PEERS     []string `json:"peers"`
+	BRIDGES   []string `json:"bridges"`
 }
 
 func setDefaults(config *Config) {
@@ -111,12 +182,53 @@ func main() {
 	service_target_port := config.TARGET_PORT
 	service_vwr_session_duration = config.SESSION_DURATION
 	routes = config.VWR_ROUTES
+	for name := range routes {
+		if !routeNamePattern.MatchString(name) {
+			log.Printf("route name %s does not fit in user table keys, its visitors will not be queued\n", name)
+		}
+	}
+	service_name = config.NAME
+	service_vwr_token_secret = config.VWR_TOKEN_SECRET
+	service_vwr_session_keys = config.VWR_SESSION_KEYS
+	if err := validateSessionKeys(service_vwr_session_keys); err != nil {
+		fmt.Println("Error in vwr_session_keys:", err)
+		return
+	}
+	service_vwr_state_file = config.VWR_STATE_FILE
+	service_vwr_session_token_ttl = config.VWR_SESSION_TTL
+	if service_vwr_session_token_ttl <= 0 {
+		service_vwr_session_token_ttl = DEFAULT_SESSION_TOKEN_TTL
+	}
+	service_vwr_template_dir = config.VWR_TEMPLATE_DIR
+	service_vwr_autoscale_log = config.VWR_AUTOSCALE_LOG
+	service_vwr_ipv4_prefix = config.VWR_IPV4_PREFIX
+	if service_vwr_ipv4_prefix <= 0 || service_vwr_ipv4_prefix > 32 {
+		service_vwr_ipv4_prefix = DEFAULT_IPV4_PREFIX
+	}
+	service_vwr_ipv6_prefix = config.VWR_IPV6_PREFIX
+	if service_vwr_ipv6_prefix <= 0 || service_vwr_ipv6_prefix > 128 {
+		service_vwr_ipv6_prefix = DEFAULT_IPV6_PREFIX
+	}
+	service_vwr_abandon_grace = config.VWR_ABANDON_GRACE
+	if service_vwr_abandon_grace <= 0 {
+		service_vwr_abandon_grace = DEFAULT_ABANDON_GRACE
+	}
+	service_max_relay_hops = config.MAX_RELAY_HOPS
+	if service_max_relay_hops <= 0 {
+		service_max_relay_hops = DEFAULT_MAX_RELAY_HOPS
+	}
 
 	initLogger()
 
 	cFlag := flag.Bool("c", false, "generate haproxy configuration (boolean)")
+	tFlag := flag.String("t", "", "generate an access token for the route, * for every route (string)")
+	laneFlag := flag.String("lane", "", "priority lane of the generated token, bypass token if empty (string)")
+	ttlFlag := flag.Int("ttl", 60, "validity of the generated token in minutes (int)")
 	flag.Parse()
 
+	initGroups(service_mode, config.PEER_GROUPS)
+	initCatalogs(config.VWR_LOCALES)
+
 	go initWebServer(service_web_host, service_web_port)
 	listen, err := net.Listen("tcp", service_tcp_host+":"+service_tcp_port)
 	if err != nil {
@@ -126,14 +238,50 @@ func main() {
 
 	if service_mode == "vwr" {
 		if *cFlag {
-			generateHAProxyConfiguration(service_vwr_room_table, config.VWR_ROUTES, service_web_host, service_web_port, service_tcp_host, service_tcp_port, service_target_port)
+			generateHAProxyConfiguration(service_vwr_room_table, service_vwr_user_table, config.VWR_ROUTES, service_web_host, service_web_port, service_tcp_host, service_tcp_port, service_target_port)
 			os.Exit(0)
 		}
 
+		if *tFlag != "" {
+			generateAccessToken(*tFlag, *laneFlag, *ttlFlag)
+			os.Exit(0)
+		}
+
+		roomMutex.Lock()
+		loadRouteStates()
 		initRoomTable()
-		go initCache()
+		roomMutex.Unlock()
+		initSessions()
+		go runAdmissions()
+		go runEvents()
+		go runAbandonment()
+		go runMetrics()
+		initWebhooks(config.VWR_WEBHOOKS)
+		go runAutoscale()
+		initChallenges()
+		initTrustedProxies(config.TRUSTED_PROXIES)
+		for name, route := range routes {
+			warnUntrustedProxies(name, route)
+		}
 	}
 
+	for _, group := range groups {
+		if group.config.TCP_PORT == "" {
+			continue
+		}
+
+		groupListen, err := net.Listen("tcp", service_tcp_host+":"+group.config.TCP_PORT)
+		if err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+		go acceptPeers(groupListen, service_mode, group)
+	}
+
+	acceptPeers(listen, service_mode, nil)
+}
+
+func acceptPeers(listen net.Listener, mode string, group *Group) {
 	defer listen.Close()
 	for {
 		conn, err := listen.Accept()
@@ -142,13 +290,9 @@ func main() {
 			os.Exit(1)
 		}
 
-		client := &Client{
-			active: true,
-			conn:   conn,
-			reader: bufio.NewReader(conn),
-		}
-		peers = append(peers, client)
-		go client.initConnection(service_mode)
+		client := newClient(conn, group)
+		addPeer(client)
+		go client.initConnection(mode)
 	}
 }
 
@@ -181,31 +325,84 @@ func initRoomTable() {
 			Key: name,
 		}
 		roomEntry.Values = make(map[int][]int)
-		roomEntry.Values[GPC0] = []int{route.TOTAL_ACTIVE_USERS}
+		roomEntry.Values[GPC0] = []int{route.roomSlots()}
 		roomTable.entries[keyEnc] = roomEntry
-		sortedEntries[name] = make([]string, 0)
+		sortedEntries[name] = newLane()
 	}
 	tables[service_vwr_room_table] = roomTable
 }
 
-func updateRoomTable(name string, path string, host string, activeUsers int) {
+// updateRoomTable creates or updates a route without touching its queue, a
+// capacity change moves the free slots of the room by the difference
+func updateRoomTable(name string, route Route) {
+	previous, exists := routes[name]
+	previousSlots := exists && previous.admissionMode() == ADMISSION_CONCURRENCY && routeOpen(name)
+	if exists {
+		route.STATE = previous.STATE
+		route.CLOSED = previous.CLOSED
+	}
+	routes[name] = route
+	if exists && previous.TOTAL_ACTIVE_USERS != route.TOTAL_ACTIVE_USERS {
+		fireWebhook(EVENT_CAPACITY_CHANGED, name, map[string]interface{}{"previous": previous.TOTAL_ACTIVE_USERS, "capacity": route.TOTAL_ACTIVE_USERS})
+	}
+
 	var key []byte = []byte(name)
 
 	jsonKey, _ := json.Marshal(&key)
 	keyEnc := b64.StdEncoding.EncodeToString(jsonKey)
 
-	roomEntry := Entry{
-		Key: name,
+	roomEntry, roomExists := tables[service_vwr_room_table].entries[keyEnc]
+	if !roomExists {
+		roomEntry = Entry{
+			Key: name,
+		}
+		roomEntry.Values = make(map[int][]int)
+		roomEntry.Values[GPC0] = []int{0}
+		tables[service_vwr_room_table].entries[keyEnc] = roomEntry
+		laneQueue(name, DEFAULT_LANE)
+		setRoomSlots(name, route.roomSlots())
+		return
 	}
-	roomEntry.Values = make(map[int][]int)
-	roomEntry.Values[GPC0] = []int{activeUsers}
-	tables[service_vwr_room_table].entries[keyEnc] = roomEntry
-	sortedEntries[name] = make([]string, 0)
-	routes[name] = Route{
-		TOTAL_ACTIVE_USERS: activeUsers,
-		PATH:               path,
-		HOST:               host,
+
+	if route.roomSlots() == 0 {
+		setRoomSlots(name, 0)
+	} else if previousSlots {
+		fillRoom(name, roomEntry.Values[GPC0][0]+route.TOTAL_ACTIVE_USERS-previous.TOTAL_ACTIVE_USERS)
+	} else {
+		refillRoom(name, route)
+	}
+}
+
+// deleteRoomTable removes a route, HAProxy gets no free slot for it anymore
+// and its waiting visitors get the closed page. Active sessions expire on
+// their own.
+func deleteRoomTable(name string) bool {
+	if _, exists := routes[name]; !exists {
+		return false
 	}
+
+	setRoomSlots(name, 0)
+	notifyRoute(name, sseFrame("closed", ""))
+	clearQueue(name)
+
+	var key []byte = []byte(name)
+
+	jsonKey, _ := json.Marshal(&key)
+	keyEnc := b64.StdEncoding.EncodeToString(jsonKey)
+
+	delete(tables[service_vwr_room_table].entries, keyEnc)
+	delete(routes, name)
+	delete(eventStates, name)
+	delete(admissionCredits, name)
+	// the slots of the route are gone with it
+	sessions.RemoveRoute(name)
+	delete(sortedEntries, name)
+	delete(priorityLanes, name)
+	delete(laneCurrent, name)
+	delete(preQueue, name)
+	saveRouteStates()
+	sendRouteUpdate()
+	return true
 }
 
 func initLogger() {
@@ -213,8 +410,7 @@ func initLogger() {
 	log.SetPrefix("lineQ   ")
 }
 
-func generateHAProxyConfiguration(roomTable string, routes map[string]Route, webHost string, webPort string, tcpHost string, tcpPort string, targetPort string) {
-	session_duration := 5
+func generateHAProxyConfiguration(roomTable string, userTable string, routes map[string]Route, webHost string, webPort string, tcpHost string, tcpPort string, targetPort string) {
 	fileName := "haproxy.cfg"
 	config := ""
 	file, err := os.Create(fileName)
@@ -234,13 +430,16 @@ func generateHAProxyConfiguration(roomTable string, routes map[string]Route, web
 	config += fmt.Sprintf("backend %s\n", roomTable)
 	config += fmt.Sprintf("\tstick-table type string size %v expire 1d store gpc0 peers lineq\n", len(routes))
 
-	other := "if"
-	for name, route := range routes {
-		path := route.PATH
-		other += fmt.Sprintf(" !{ var(txn.path) -i -m beg %s }", path)
-		config += fmt.Sprintf("\nbackend %s\n", name)
-		config += fmt.Sprintf("\tstick-table type string len 36 size 100k expire %vm store gpc1 peers lineq\n", session_duration)
+	// one user table for every route, its keys carry the route and lineq
+	// expires sessions after the duration of their route
+	expire := service_vwr_session_duration
+	for _, route := range routes {
+		if route.sessionDuration() > expire {
+			expire = route.sessionDuration()
+		}
 	}
+	config += fmt.Sprintf("\nbackend %s\n", userTable)
+	config += fmt.Sprintf("\tstick-table type string len %d size 100k expire %vm store gpc1 peers lineq\n", USER_KEY_LEN, expire)
 
 	config += fmt.Sprintln("\nfrontend fe_main")
 
@@ -251,29 +450,74 @@ func generateHAProxyConfiguration(roomTable string, routes map[string]Route, web
 		config += fmt.Sprintf("\tbind *:%s\n", targetPort)
 	}
 
-	config += fmt.Sprintf("\thttp-request set-var(txn.has_cookie) req.cook_cnt(sessionid)\n")
-	config += fmt.Sprintf("\thttp-request set-var(txn.t2) uuid()  if !{ var(txn.has_cookie) -m int gt 0 }\n")
-	config += fmt.Sprintf("\thttp-request set-var(txn.sessionid) req.cook(sessionid)\n")
+	// with signed sessions the session ids come from lineq only, a visitor
+	// is tracked once it holds the session cookie of its route
+	signed := signedSessions()
+	if !signed {
+		config += fmt.Sprintf("\thttp-request set-var(txn.has_cookie) req.cook_cnt(sessionid)\n")
+		config += fmt.Sprintf("\thttp-request set-var(txn.t2) uuid()  if !{ var(txn.has_cookie) -m int gt 0 }\n")
+		config += fmt.Sprintf("\thttp-request set-var(txn.sessionid) req.cook(sessionid)\n")
+	}
+	config += fmt.Sprintf("\thttp-request set-var(txn.host) req.hdr(host),field(1,:),lower\n")
 	config += fmt.Sprintf("\thttp-request set-var(txn.path) path\n")
-	config += fmt.Sprintf("\tacl other %s\n", other)
+	if !signed {
+		config += fmt.Sprintf("\thttp-request set-var(txn.sid) var(txn.sessionid) if { var(txn.has_cookie) -m int gt 0 }\n")
+		config += fmt.Sprintf("\thttp-request set-var(txn.sid) var(txn.t2) if !{ var(txn.has_cookie) -m int gt 0 }\n")
+	}
+	// the first route of lineq's order that matches the request wins
+	order := routeOrder(routes)
+	for _, name := range order {
+		config += fmt.Sprintf("\thttp-request set-var(txn.route) str(%s) if !{ var(txn.route) -m found } %s\n", name, routes[name].haproxyMatch())
+	}
+	config += fmt.Sprintf("\tacl other !{ var(txn.route) -m found }\n")
 	config += fmt.Sprintf("\tuse_backend bk_default if other\n")
-	for name, route := range routes {
-		path := route.PATH
-		config += fmt.Sprintf("\thttp-request track-sc0 str(\"%s\") table %s if { var(txn.path) -i -m beg %s }\n", name, roomTable, path)
-		config += fmt.Sprintf("\thttp-response add-header Set-Cookie \"sessionid=%%[var(txn.t2)]; path=%s\" if { var(txn.path) -i -m beg %s } !{ var(txn.has_cookie) -m int gt 0 }\n", path, route.PATH)
-		config += fmt.Sprintf("\thttp-request track-sc1 var(txn.sessionid) table %s if { var(txn.path) -i -m beg %s } { var(txn.has_cookie) -m int gt 0 }\n", name, path)
-		config += fmt.Sprintf("\thttp-request track-sc1 var(txn.t2) table %s if { var(txn.path) -i -m beg %s } !{ var(txn.has_cookie) -m int gt 0 }\n", name, path)
-		config += fmt.Sprintf("\thttp-request set-var(txn.backid) \"str('bk_'),concat('%s')\" if { var(txn.path) -i -m beg %s } \n", name, path)
+	for _, name := range order {
+		route := routes[name]
+		if len(route.DENY) > 0 {
+			config += haproxyAcls("deny_"+name, route.DENY)
+			config += fmt.Sprintf("\thttp-request deny if deny_%s { var(txn.route) -m str %s }\n", name, name)
+		}
+		if len(route.BYPASS) > 0 {
+			config += haproxyAcls("bypass_"+name, route.BYPASS)
+		}
+	}
+	for _, name := range order {
+		route := routes[name]
+		matched := fmt.Sprintf("{ var(txn.route) -m str %s }", name)
+		// bypassed visitors are never tracked by the room
+		tracked := ""
+		if len(route.BYPASS) > 0 {
+			tracked = fmt.Sprintf(" !bypass_%s", name)
+		}
+		config += fmt.Sprintf("\thttp-request track-sc0 str(\"%s\") table %s if %s%s\n", name, roomTable, matched, tracked)
+		if signed {
+			config += fmt.Sprintf("\thttp-request set-var(txn.sid) req.cook(%s) if %s\n", sessionCookie(name), matched)
+			tracked += " { var(txn.sid) -m len gt 0 }"
+		} else {
+			config += fmt.Sprintf("\thttp-response add-header Set-Cookie \"sessionid=%%[var(txn.t2)]; path=%s\" if %s !{ var(txn.has_cookie) -m int gt 0 }\n", route.basePath(), matched)
+		}
+		config += fmt.Sprintf("\thttp-request set-var(txn.userkey) str(%s),concat(,txn.sid,) if %s\n", UserKey{Route: name}.String(), matched)
+		config += fmt.Sprintf("\thttp-request track-sc1 var(txn.userkey) table %s if %s%s\n", userTable, matched, tracked)
+		config += fmt.Sprintf("\thttp-request set-var(txn.backid) \"str('bk_'),concat('%s')\" if %s\n", name, matched)
 	}
 
+	if !signed {
+		config += fmt.Sprintf("\thttp-request set-header %s %%[var(txn.sid)]\n", SESSION_HEADER)
+	}
 	config += fmt.Sprintf("\tacl has_slot sc_get_gpc1(1) eq 1\n")
 	config += fmt.Sprintf("\tacl free_slot sc_get_gpc0(0) gt 0\n")
 	config += fmt.Sprintf("\thttp-request sc-inc-gpc1(1) if free_slot !has_slot\n")
+	for _, name := range order {
+		if len(routes[name].BYPASS) > 0 {
+			config += fmt.Sprintf("\tuse_backend %%[var(txn.backid)] if bypass_%s { var(txn.route) -m str %s }\n", name, name)
+		}
+	}
 	config += fmt.Sprintf("\tuse_backend %%[var(txn.backid)] if has_slot\n")
 	config += fmt.Sprintf("\tdefault_backend bk_no\n")
 
 	config += fmt.Sprintln("\nbackend bk_no")
 	config += fmt.Sprintln("\tmode http")
+	config += fmt.Sprintln("\toption forwardfor")
 	config += fmt.Sprintf("\tserver lineq %s:%s\n", webHost, webPort)
 
 	/*
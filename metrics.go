@@ -0,0 +1,218 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// every route keeps METRICS_POINTS samples of METRICS_INTERVAL, two hours
+const METRICS_INTERVAL = 10 * time.Second
+const METRICS_POINTS = 720
+
+// MetricPoint is what happened on a route during one interval, waits are in
+// seconds from entering the queue to admission, -1 when nobody was admitted
+// from the queue
+type MetricPoint struct {
+	Time        time.Time `json:"time"`
+	QueueLength int       `json:"queue"`
+	Admissions  int       `json:"admissions"`
+	Expirations int       `json:"expirations"`
+	Abandoned   int       `json:"abandoned"`
+	WaitP50     float64   `json:"wait_p50"`
+	WaitP95     float64   `json:"wait_p95"`
+}
+
+// Series is a ring buffer of the last METRICS_POINTS points of a route
+type Series struct {
+	points []MetricPoint
+	next   int
+}
+
+// routeCounters accumulates the events of the current interval
+type routeCounters struct {
+	admissions  int
+	expirations int
+	abandoned   int
+	waits       []float64
+}
+
+type queuedSession struct {
+	route string
+	since time.Time
+}
+
+var series = make(map[string]*Series)
+var counters = make(map[string]*routeCounters)
+var queuedSince = make(map[string]queuedSession)
+var metricsMutex sync.Mutex
+
+func newSeries() *Series {
+	return &Series{points: make([]MetricPoint, 0, METRICS_POINTS)}
+}
+
+func (s *Series) add(point MetricPoint) {
+	if len(s.points) < METRICS_POINTS {
+		s.points = append(s.points, point)
+		return
+	}
+	s.points[s.next] = point
+	s.next = (s.next + 1) % METRICS_POINTS
+}
+
+// since returns the points after a time, oldest first
+func (s *Series) since(from time.Time) []MetricPoint {
+	points := make([]MetricPoint, 0, len(s.points))
+	for i := 0; i < len(s.points); i++ {
+		point := s.points[(s.next+i)%len(s.points)]
+		if point.Time.After(from) {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+func routeCounter(name string) *routeCounters {
+	counter, exists := counters[name]
+	if !exists {
+		counter = &routeCounters{}
+		counters[name] = counter
+	}
+	return counter
+}
+
+// markQueued remembers when a session entered the queue of a route
+func markQueued(name string, keyEnc string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	queuedSince[keyEnc] = queuedSession{route: name, since: time.Now()}
+}
+
+// markAdmitted samples the wait of a session lineq admitted from the queue
+func markAdmitted(name string, keyEnc string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	queued, exists := queuedSince[keyEnc]
+	if !exists || queued.route != name {
+		return
+	}
+	delete(queuedSince, keyEnc)
+	counter := routeCounter(name)
+	counter.waits = append(counter.waits, time.Since(queued.since).Seconds())
+}
+
+func countAdmission(name string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	routeCounter(name).admissions++
+}
+
+func countExpiration(name string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	routeCounter(name).expirations++
+}
+
+func countAbandonment(name string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	routeCounter(name).abandoned++
+}
+
+// percentile returns the nearest-rank percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return -1
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return math.Round(sorted[rank]*10) / 10
+}
+
+// runMetrics closes an interval of every route and forgets the sessions that
+// left the queue without being admitted
+func runMetrics() {
+	ticker := time.NewTicker(METRICS_INTERVAL)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		roomMutex.Lock()
+		lengths := make(map[string]int)
+		for name := range routes {
+			lengths[name] = queueLength(name)
+		}
+
+		metricsMutex.Lock()
+		for name, length := range lengths {
+			counter := routeCounter(name)
+			sort.Float64s(counter.waits)
+
+			if _, exists := series[name]; !exists {
+				series[name] = newSeries()
+			}
+			series[name].add(MetricPoint{
+				Time:        now,
+				QueueLength: length,
+				Admissions:  counter.admissions,
+				Expirations: counter.expirations,
+				Abandoned:   counter.abandoned,
+				WaitP50:     percentile(counter.waits, 50),
+				WaitP95:     percentile(counter.waits, 95),
+			})
+			counters[name] = &routeCounters{}
+		}
+		for name := range series {
+			if _, exists := lengths[name]; !exists {
+				delete(series, name)
+				delete(counters, name)
+			}
+		}
+		for keyEnc, queued := range queuedSince {
+			if !isQueued(queued.route, keyEnc) {
+				delete(queuedSince, keyEnc)
+			}
+		}
+		metricsMutex.Unlock()
+		roomMutex.Unlock()
+	}
+}
+
+// getMetrics serves GET /api/v1/metrics, the points of every route or of
+// the route parameter, since=unix seconds returns only newer points
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	from := time.Time{}
+	if since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64); err == nil {
+		from = time.Unix(since, 0)
+	}
+	name := r.URL.Query().Get("route")
+	if _, exists := routes[name]; name != "" && !exists {
+		http.Error(w, "Unknown route", http.StatusNotFound)
+		return
+	}
+
+	metricsMutex.Lock()
+	points := make(map[string][]MetricPoint)
+	for route, s := range series {
+		if name == "" || route == name {
+			points[route] = s.since(from)
+		}
+	}
+	metricsMutex.Unlock()
+
+	writeJSON(w, http.StatusOK, points)
+}
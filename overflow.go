@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const DEFAULT_RETRY_AFTER = 60
+
+func (route Route) retryAfter() int {
+	if route.RETRY_AFTER > 0 {
+		return route.RETRY_AFTER
+	}
+	return DEFAULT_RETRY_AFTER
+}
+
+func queueFull(name string) bool {
+	maxQueueLength := routes[name].MAX_QUEUE_LENGTH
+	return maxQueueLength > 0 && queueLength(name) >= maxQueueLength
+}
+
+func isQueued(name string, keyEnc string) bool {
+	if queuePosition(name, keyEnc) > 0 {
+		return true
+	}
+	waiting, exists := preQueue[name]
+	return exists && waiting.Contains(keyEnc)
+}
+
+// serveOverflowPage answers newcomers of a full queue with the "try later"
+// page of the route, it returns false when the waiting page has to be served
+func serveOverflowPage(w http.ResponseWriter, r *http.Request) bool {
+	name, keyEnc := requestRoute(r)
+	route, exists := routes[name]
+	if !exists || !queueFull(name) || isQueued(name, keyEnc) {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(route.retryAfter()))
+	renderPage(w, name, route.fullTemplate(), pageData(r, name, keyEnc), http.StatusServiceUnavailable)
+	return true
+}
+
+// closeRoute switches a route to the sold out state: visitors waiting on it
+// get the closed page and nobody is admitted anymore. Reopening gives back
+// the slots that are not held by active sessions.
+func closeRoute(name string, closed bool) bool {
+	route, exists := routes[name]
+	if !exists {
+		return false
+	}
+
+	route.CLOSED = closed
+	routes[name] = route
+	saveRouteStates()
+	sendRouteUpdate()
+
+	if closed {
+		log.Printf("route %s closed\n", name)
+		setRoomSlots(name, 0)
+		clearQueue(name)
+		notifyRoute(name, sseFrame("closed", ""))
+		return true
+	}
+
+	log.Printf("route %s reopened\n", name)
+	if route.admissionMode() == ADMISSION_CONCURRENCY && routeOpen(name) {
+		refillRoom(name, route)
+	}
+	return true
+}
+
+// clearQueue drops every waiting session of a route, so that they enter the
+// queue again on their next request
+func clearQueue(name string) {
+	for _, queue := range routeLanes(name) {
+		for _, keyEnc := range queue.Keys() {
+			dropSession(name, keyEnc)
+		}
+	}
+	if waiting, exists := preQueue[name]; exists {
+		for _, keyEnc := range waiting.Keys() {
+			dropSession(name, keyEnc)
+		}
+	}
+	resetLanes(name)
+	delete(preQueue, name)
+}
+
+func sseFrame(event string, data string) string {
+	if event == "" {
+		return fmt.Sprintf("data: %s\n\n", data)
+	}
+	return fmt.Sprintf("event: %s\ndata: %s\n\n", event, data)
+}
@@ -0,0 +1,146 @@
+package main
+
+// LANE_COMPACT_MIN is the number of dequeued slots a lane keeps before it
+// rebuilds its index
+const LANE_COMPACT_MIN = 1024
+
+// fenwick is a binary indexed tree over 1-based positions, index 0 is unused
+type fenwick []int
+
+func newFenwick() fenwick {
+	return fenwick{0}
+}
+
+func (tree fenwick) add(i int, delta int) {
+	for i < len(tree) {
+		tree[i] += delta
+		i += i & -i
+	}
+}
+
+// sum returns the total of the positions 1 to i
+func (tree fenwick) sum(i int) int {
+	total := 0
+	for i > 0 {
+		total += tree[i]
+		i -= i & -i
+	}
+	return total
+}
+
+// push appends a position holding value, the new node covers the range
+// (n - lowbit(n), n] so it is built from the prefix sums before it
+func (tree *fenwick) push(value int) {
+	n := len(*tree)
+	node := value + tree.sum(n-1) - tree.sum(n-(n&-n))
+	*tree = append(*tree, node)
+}
+
+// Lane is a FIFO queue of sessions that finds the position of any of them in
+// O(log n). Every session gets the next sequence number when it enters, the
+// tree counts the sequences still waiting so the position of a session is
+// the number of waiting sessions up to its own sequence.
+type Lane struct {
+	keys    []string
+	seqs    map[string]int
+	waiting fenwick
+	head    int
+	size    int
+}
+
+func newLane() *Lane {
+	return &Lane{
+		keys:    make([]string, 0),
+		seqs:    make(map[string]int),
+		waiting: newFenwick(),
+	}
+}
+
+// Push adds a session to the tail, it returns false if it already waits
+func (lane *Lane) Push(keyEnc string) bool {
+	if _, exists := lane.seqs[keyEnc]; exists {
+		return false
+	}
+	lane.keys = append(lane.keys, keyEnc)
+	lane.seqs[keyEnc] = len(lane.keys)
+	lane.waiting.push(1)
+	lane.size++
+	return true
+}
+
+// Pop removes the session at the head
+func (lane *Lane) Pop() (string, bool) {
+	for lane.head < len(lane.keys) && lane.keys[lane.head] == "" {
+		lane.head++
+	}
+	if lane.head == len(lane.keys) {
+		return "", false
+	}
+
+	keyEnc := lane.keys[lane.head]
+	lane.Remove(keyEnc)
+	return keyEnc, true
+}
+
+// Remove takes a session out of the lane wherever it is
+func (lane *Lane) Remove(keyEnc string) bool {
+	seq, exists := lane.seqs[keyEnc]
+	if !exists {
+		return false
+	}
+	lane.waiting.add(seq, -1)
+	lane.keys[seq-1] = ""
+	delete(lane.seqs, keyEnc)
+	lane.size--
+	lane.compact()
+	return true
+}
+
+// Position returns the 1-based position of a session, 0 when it is not in
+// the lane
+func (lane *Lane) Position(keyEnc string) int {
+	seq, exists := lane.seqs[keyEnc]
+	if !exists {
+		return 0
+	}
+	return lane.waiting.sum(seq)
+}
+
+func (lane *Lane) Contains(keyEnc string) bool {
+	_, exists := lane.seqs[keyEnc]
+	return exists
+}
+
+func (lane *Lane) Len() int {
+	return lane.size
+}
+
+// Keys returns the waiting sessions from head to tail
+func (lane *Lane) Keys() []string {
+	keys := make([]string, 0, lane.size)
+	for _, keyEnc := range lane.keys[lane.head:] {
+		if keyEnc != "" {
+			keys = append(keys, keyEnc)
+		}
+	}
+	return keys
+}
+
+// compact renumbers the lane once most of its sequences are gone, so that
+// the index does not grow with every session that ever waited
+func (lane *Lane) compact() {
+	removed := len(lane.keys) - lane.size
+	if removed < LANE_COMPACT_MIN || removed*2 < len(lane.keys) {
+		return
+	}
+
+	keys := lane.Keys()
+	lane.keys = make([]string, 0, len(keys))
+	lane.seqs = make(map[string]int, len(keys))
+	lane.waiting = newFenwick()
+	lane.head = 0
+	lane.size = 0
+	for _, keyEnc := range keys {
+		lane.Push(keyEnc)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sliceLane is the obvious FIFO the lane is checked against
+type sliceLane []string
+
+func (queue sliceLane) position(keyEnc string) int {
+	for i, key := range queue {
+		if key == keyEnc {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (queue *sliceLane) remove(keyEnc string) bool {
+	if i := queue.position(keyEnc); i > 0 {
+		*queue = append((*queue)[:i-1], (*queue)[i:]...)
+		return true
+	}
+	return false
+}
+
+func TestLaneMatchesSlice(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	lane := newLane()
+	expected := sliceLane{}
+	next := 0
+
+	// enough removals for the lane to compact several times
+	for step := 0; step < 20000; step++ {
+		switch op := random.Intn(10); {
+		case op < 4:
+			keyEnc := strconv.Itoa(next)
+			next++
+			if !lane.Push(keyEnc) {
+				t.Fatalf("step %d: push of new session %s failed", step, keyEnc)
+			}
+			expected = append(expected, keyEnc)
+		case op < 6:
+			keyEnc, ok := lane.Pop()
+			if ok != (len(expected) > 0) {
+				t.Fatalf("step %d: pop returned %v with %d waiting", step, ok, len(expected))
+			}
+			if ok {
+				if keyEnc != expected[0] {
+					t.Fatalf("step %d: popped %s, want %s", step, keyEnc, expected[0])
+				}
+				expected = expected[1:]
+			}
+		case op < 8:
+			keyEnc := strconv.Itoa(random.Intn(next + 1))
+			if got, want := lane.Remove(keyEnc), expected.remove(keyEnc); got != want {
+				t.Fatalf("step %d: remove %s returned %v, want %v", step, keyEnc, got, want)
+			}
+		default:
+			if len(expected) > 0 && lane.Push(expected[random.Intn(len(expected))]) {
+				t.Fatalf("step %d: a waiting session was pushed twice", step)
+			}
+		}
+
+		if lane.Len() != len(expected) {
+			t.Fatalf("step %d: length %d, want %d", step, lane.Len(), len(expected))
+		}
+		for i := 0; i < 3 && len(expected) > 0; i++ {
+			keyEnc := expected[random.Intn(len(expected))]
+			if got, want := lane.Position(keyEnc), expected.position(keyEnc); got != want {
+				t.Fatalf("step %d: position of %s is %d, want %d", step, keyEnc, got, want)
+			}
+		}
+		if lane.Position(strconv.Itoa(next)) != 0 {
+			t.Fatalf("step %d: a session that never waited has a position", step)
+		}
+	}
+
+	if keys := lane.Keys(); !reflect.DeepEqual(keys, []string(expected)) && len(expected) > 0 {
+		t.Errorf("keys %v, want %v", keys, expected)
+	}
+	if len(lane.keys) > 2*LANE_COMPACT_MIN+2*lane.Len() {
+		t.Errorf("the lane kept %d slots for %d sessions", len(lane.keys), lane.Len())
+	}
+}
+
+// laneOf returns the lane a test session was pushed to
+func laneOf(keyEnc string) string {
+	return strings.SplitN(keyEnc, "-", 2)[0]
+}
+
+func TestPopLaneWeights(t *testing.T) {
+	withRoomState(t, map[string]Route{"shop": {HOST: "shop.example.com", PATH: "/", LANES: map[string]int{"vip": 3, "press": 2}}})
+
+	// a lane the route no longer has drains like the default lane
+	lanes := []string{DEFAULT_LANE, "vip", "press", "removed"}
+	for i := 0; i < 200; i++ {
+		for _, lane := range lanes {
+			laneQueue("shop", lane).Push(lane + "-" + strconv.Itoa(i))
+		}
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 140; i++ {
+		keyEnc, ok := popLane("shop")
+		if !ok {
+			t.Fatalf("lanes ran empty after %d admissions", i)
+		}
+		counts[laneOf(keyEnc)]++
+
+		// the weights are 1:3:2:1, every 7 admissions serve them exactly
+		if (i+1)%7 == 0 && counts["vip"] != 3*counts[DEFAULT_LANE] {
+			t.Fatalf("after %d admissions %v", i+1, counts)
+		}
+	}
+	if want := map[string]int{DEFAULT_LANE: 20, "vip": 60, "press": 40, "removed": 20}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("admissions %v, want %v", counts, want)
+	}
+
+	// an empty lane gives its share to the others
+	for laneQueue("shop", "vip").Len() > 0 {
+		laneQueue("shop", "vip").Pop()
+	}
+	counts = make(map[string]int)
+	for i := 0; i < 40; i++ {
+		keyEnc, _ := popLane("shop")
+		counts[laneOf(keyEnc)]++
+	}
+	if want := map[string]int{DEFAULT_LANE: 10, "press": 20, "removed": 10}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("admissions without vip %v, want %v", counts, want)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const RELAY_WINDOW = 2 * time.Second
+
+// Origin identifies where an update entered lineq: the HAProxy (or lineq)
+// peer it was received from, or this instance for locally generated updates.
+// Hops counts how many times the same update passed through this instance.
+// The peers protocol has no room for it, so the origin never leaves the
+// instance and loops are detected by content only.
+type Origin struct {
+	ID   string
+	Hops int
+	peer *Client
+}
+
+type relayRecord struct {
+	digest string
+	origin Origin
+	seen   time.Time
+}
+
+var relayHistory = make(map[string]relayRecord)
+var relayPruned time.Time
+var relayMutex sync.Mutex
+var service_name string
+var service_max_relay_hops int
+
+func localOrigin() Origin {
+	return Origin{
+		ID:   service_name,
+		Hops: 0,
+	}
+}
+
+func peerOrigin(client *Client) Origin {
+	return Origin{
+		ID:   client.name,
+		Hops: 1,
+		peer: client,
+	}
+}
+
+// shouldRelay reports whether an update received from a peer has to be
+// forwarded. An update with the same content coming back from another peer
+// shortly after it was relayed is a loop between relays (e.g. clustered lineq
+// instances), it is forwarded again only while its hop count allows it.
+func (group *Group) shouldRelay(tableName string, keyEnc string, values map[int][]int, origin Origin) (Origin, bool) {
+	relayMutex.Lock()
+	defer relayMutex.Unlock()
+
+	id := fmt.Sprintf("%s/%s/%s", group.name, tableName, keyEnc)
+	digest := fmt.Sprint(values)
+	now := time.Now()
+
+	if now.Sub(relayPruned) >= RELAY_WINDOW {
+		pruneRelayHistory(now)
+	}
+
+	if record, exists := relayHistory[id]; exists && record.digest == digest && now.Sub(record.seen) < RELAY_WINDOW {
+		if record.origin.ID == origin.ID {
+			// HAProxy resends its own update, nothing new to relay
+			return record.origin, false
+		}
+
+		origin.Hops = record.origin.Hops + 1
+		if origin.Hops > service_max_relay_hops {
+			log.Printf("dropping looped update %s from %s after %d hops\n", id, origin.ID, origin.Hops)
+			return origin, false
+		}
+	}
+
+	relayHistory[id] = relayRecord{
+		digest: digest,
+		origin: origin,
+		seen:   now,
+	}
+	return origin, true
+}
+
+// pruneRelayHistory forgets the updates relayed more than RELAY_WINDOW ago,
+// they can no longer be taken for a loop
+func pruneRelayHistory(now time.Time) {
+	for id, record := range relayHistory {
+		if now.Sub(record.seen) >= RELAY_WINDOW {
+			delete(relayHistory, id)
+		}
+	}
+	relayPruned = now
+}
@@ -1,96 +1,168 @@
 package main
 
 import (
-	"context"
 	"log"
+	"sync"
 	"time"
 
 	b64 "encoding/base64"
 	"encoding/binary"
 	"encoding/json"
-
-	"github.com/allegro/bigcache/v3"
 )
 
-var cache *bigcache.BigCache
-
-func initCache() {
-	vwr_total_users := 100000
-
-	onRemove := func(key string, entry []byte) {
-		usersTable := string(entry)
-
-		delete(tables[service_vwr_user_table].entries, key)
-		if len(sortedEntries[usersTable]) > 0 {
-			newKey := sortedEntries[usersTable][0]
-			tables[service_vwr_user_table].entries[newKey].Values[GPC1][0] = 1
-			sortedEntries[usersTable] = sortedEntries[usersTable][1:]
-			tableDef := tables[service_vwr_user_table].definition
-			keyValue := tables[service_vwr_user_table].entries[newKey].Key
-			updateClients(tableDef, newKey, keyValue)
-			cache.Set(newKey, entry)
-			sendTableUpdate(service_vwr_user_table, newKey)
-			broadcast()
-		} else {
-			var roomKey []byte = entry
-			roomJson, _ := json.Marshal(&roomKey)
-			roomEnc := b64.StdEncoding.EncodeToString(roomJson)
-			curVal := tables[service_vwr_room_table].entries[roomEnc].Values[GPC0][0]
+var sessions *ExpiryScheduler
 
-			if curVal < routes[usersTable].TOTAL_ACTIVE_USERS {
-				tables[service_vwr_room_table].entries[roomEnc].Values[GPC0][0] += 1
-				tableDef := tables[service_vwr_room_table].definition
+// ENDED_SESSION_TTL is how long the queue API reports a session lineq let go
+// of as expired
+const ENDED_SESSION_TTL = 10 * time.Minute
 
-				updateClients(tableDef, roomEnc, usersTable)
-				sendTableUpdate(service_vwr_room_table, roomEnc)
-			}
-		}
+// endedSessions remembers the sessions lineq let go of, so that the queue API
+// tells them from the sessions HAProxy did not report yet
+var endedSessions *ExpiryScheduler
+
+// roomMutex guards the state of the waiting room: the routes, the tables,
+// the lanes and pre-queues and the sessions. It is taken where work starts
+// (the tickers, the peers, the expiry of sessions and the web handlers), the
+// functions they call expect it held.
+var roomMutex sync.Mutex
+
+// withRoom runs f with the waiting room locked, for the streams that cannot
+// hold the lock while they wait
+func withRoom(f func()) {
+	roomMutex.Lock()
+	defer roomMutex.Unlock()
+
+	f()
+}
+
+func initSessions() {
+	sessions = newExpiryScheduler(systemClock{}, onSessionRemove)
+	go sessions.Run(&roomMutex)
+	endedSessions = newExpiryScheduler(systemClock{}, func(string, string, RemovalReason) {})
+	go endedSessions.Run(&roomMutex)
+}
+
+// dropSession deletes the entry of a session, it has to be reported by
+// HAProxy again to come back
+func dropSession(name string, keyEnc string) {
+	delete(tables[service_vwr_user_table].entries, keyEnc)
+	endedSessions.Set(keyEnc, name, ENDED_SESSION_TTL)
+}
+
+// onSessionRemove frees the slot of an ended session, handing it to the head
+// of the route queue or giving it back to the room
+func onSessionRemove(key string, usersTable string, reason RemovalReason) {
+	log.Printf("session %s of %s %s\n", key, usersTable, reason)
+
+	dropSession(usersTable, key)
+	if reason == REMOVAL_EXPIRED {
+		countExpiration(usersTable)
+	}
+	if _, exists := bypassSessions[key]; exists {
+		// bypass sessions never held a slot of the room
+		delete(bypassSessions, key)
+		return
+	}
+	if routes[usersTable].admissionMode() == ADMISSION_RATE || !routeOpen(usersTable) {
+		// rate mode admits from the queue on its own schedule, paused and
+		// draining routes keep their slots
+		checkDrained(usersTable)
+		return
 	}
 
-	config := bigcache.Config{
-		// number of shards (must be a power of 2)
-		Shards: 1024,
+	if !admitNext(usersTable) {
+		var roomKey []byte = []byte(usersTable)
+		roomJson, _ := json.Marshal(&roomKey)
+		roomEnc := b64.StdEncoding.EncodeToString(roomJson)
+		curVal := tables[service_vwr_room_table].entries[roomEnc].Values[GPC0][0]
 
-		// time after which entry can be evicted
-		LifeWindow: time.Duration(service_vwr_session_duration) * time.Minute,
+		if curVal < routes[usersTable].TOTAL_ACTIVE_USERS {
+			tables[service_vwr_room_table].entries[roomEnc].Values[GPC0][0] += 1
+			tableDef := tables[service_vwr_room_table].definition
 
-		// Interval between removing expired entries (clean up).
-		// If set to <= 0 then no action is performed.
-		// Setting to < 1 second is counterproductive — bigcache has a one second resolution.
-		//CleanWindow: 5 * time.Minute,
-		CleanWindow: time.Duration(1) * time.Second,
+			updateClients(tableDef, roomEnc, usersTable)
+			sendTableUpdate(service_vwr_room_table, roomEnc)
+		}
+	}
+}
+
+// admitNext gives a slot to the next session of the route lanes, it returns
+// false when nobody is waiting
+func admitNext(usersTable string) bool {
+	newKey, waiting := popLane(usersTable)
+	if !waiting {
+		return false
+	}
 
-		// rps * lifeWindow, used only in initial memory allocation
-		MaxEntriesInWindow: vwr_total_users,
+	forgetSession(newKey)
+	tables[service_vwr_user_table].entries[newKey].Values[GPC1][0] = 1
+	tableDef := tables[service_vwr_user_table].definition
+	keyValue := tables[service_vwr_user_table].entries[newKey].Key
+	updateClients(tableDef, newKey, keyValue)
+	touchSession(newKey, usersTable)
+	recordAdmission(usersTable)
+	markAdmitted(usersTable, newKey)
+	sendTableUpdate(service_vwr_user_table, newKey)
+	notifyPositions(usersTable)
+	return true
+}
 
-		// max entry size in bytes, used only in initial memory allocation
-		MaxEntrySize: 64,
+// activeSessions counts the sessions holding a slot of a route, bypass
+// sessions do not
+func activeSessions(name string) int {
+	count := sessions.CountRoute(name)
+	for _, route := range bypassSessions {
+		if route == name {
+			count--
+		}
+	}
+	return count
+}
 
-		// prints information about additional memory allocation
-		Verbose: true,
+// refillRoom hands the slots of a route that are not held by active sessions
+// to the head of its queue and gives the rest back to the room
+func refillRoom(name string, route Route) {
+	fillRoom(name, route.TOTAL_ACTIVE_USERS-activeSessions(name))
+}
 
-		// cache will not allocate more memory than this limit, value in MB
-		// if value is reached then the oldest entries can be overridden for the new ones
-		// 0 value means no size limit
-		HardMaxCacheSize: vwr_total_users * (64 / 1024 / 1024),
+// fillRoom admits up to slots sessions of the queue and leaves the remaining
+// slots free in the room
+func fillRoom(name string, slots int) {
+	for slots > 0 && admitNext(name) {
+		slots--
+	}
+	if slots < 0 {
+		slots = 0
+	}
+	setRoomSlots(name, slots)
+}
 
-		// callback fired when the oldest entry is removed because of its expiration time or no space left
-		// for the new entry, or because delete was called. A bitmask representing the reason will be returned.
-		// Default value is nil which means no callback and it prevents from unwrapping the oldest entry.
-		OnRemove: onRemove,
+// setRoomSlots overwrites the free slots (gpc0) of a route in the room table
+// and pushes the new value to HAProxy
+func setRoomSlots(name string, slots int) {
+	var roomKey []byte = []byte(name)
+	roomJson, _ := json.Marshal(&roomKey)
+	roomEnc := b64.StdEncoding.EncodeToString(roomJson)
 
-		// OnRemoveWithReason is a callback fired when the oldest entry is removed because of its expiration time or no space left
-		// for the new entry, or because delete was called. A constant representing the reason will be passed through.
-		// Default value is nil which means no callback and it prevents from unwrapping the oldest entry.
-		// Ignored if OnRemove is specified.
-		OnRemoveWithReason: nil,
+	roomEntry, exists := tables[service_vwr_room_table].entries[roomEnc]
+	if !exists {
+		return
 	}
+	roomEntry.Values[GPC0][0] = slots
+	tableDef := tables[service_vwr_room_table].definition
+
+	updateClients(tableDef, roomEnc, name)
+	sendTableUpdate(service_vwr_room_table, roomEnc)
+}
 
-	var initErr error
-	cache, initErr = bigcache.New(context.Background(), config)
-	if initErr != nil {
-		log.Fatal(initErr)
+// touchSession starts the session of a user or refreshes it on activity
+func touchSession(keyEnc string, routeName string) {
+	route, exists := routes[routeName]
+	if !exists {
+		log.Printf("no route %s for session %s\n", routeName, keyEnc)
+		return
 	}
+	sessions.Set(keyEnc, routeName, time.Duration(route.sessionDuration())*time.Minute)
 }
 
 func createTableDefinition(tableDefinition TableDefinition) []byte {
@@ -185,7 +257,7 @@ func createEntryUpdate(tableDef TableDefinition, keyType int, keyValue interface
 			}
 		case GPT0, GPC0, CONN_CNT, CONN_CUR, SESS_CNT, HTTP_REQ_CNT, HTTP_ERR_CNT, GPC1:
 			message = append(message, encode(entry.Values[dataType][0])...)
-		case HTTP_REQ_RATE:
+		case HTTP_REQ_RATE, HTTP_ERR_RATE:
 			cur_tick := encode(entry.Values[dataType][0])
 			log.Println(entry.Values[dataType][0])
 			message = append(message, cur_tick...)
@@ -209,9 +281,7 @@ func createEntryUpdate(tableDef TableDefinition, keyType int, keyValue interface
 func updateClients(tdef TableDefinition, keyEnc string, keyValue interface{}) {
 	tableDef := createTableDefinition(tdef)
 	entryDef := createEntryUpdate(tdef, tdef.KeyType, keyValue, keyEnc)
-	for i := 0; i < len(peers); i++ {
-		if peers[i].active {
-			peers[i].sendUpdate(tableDef, entryDef, true)
-		}
+	for _, peer := range activePeers() {
+		peer.sendUpdate(tableDef, entryDef, true, localOrigin())
 	}
 }
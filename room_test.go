@@ -0,0 +1,107 @@
+package main
+
+import (
+	b64 "encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+// withRoomState replaces the waiting room by one holding the given routes,
+// with empty queues and a session scheduler on a fake clock
+func withRoomState(t *testing.T, configured map[string]Route) *fakeClock {
+	previousRoutes, previousTables := routes, tables
+	previousRoomTable, previousUserTable := service_vwr_room_table, service_vwr_user_table
+	previousSorted, previousLanes, previousCurrent := sortedEntries, priorityLanes, laneCurrent
+	previousPreQueue, previousEventStates := preQueue, eventStates
+	previousCredits, previousBypass, previousSessions := admissionCredits, bypassSessions, sessions
+	previousQueuedSince, previousCounters, previousSeries := queuedSince, counters, series
+	previousDetached, previousQueued, previousAbandoned := detached, queuedCounts, abandonedCounts
+	previousEnded := endedSessions
+	t.Cleanup(func() {
+		routes, tables = previousRoutes, previousTables
+		service_vwr_room_table, service_vwr_user_table = previousRoomTable, previousUserTable
+		sortedEntries, priorityLanes, laneCurrent = previousSorted, previousLanes, previousCurrent
+		preQueue, eventStates = previousPreQueue, previousEventStates
+		admissionCredits, bypassSessions, sessions = previousCredits, previousBypass, previousSessions
+		queuedSince, counters, series = previousQueuedSince, previousCounters, previousSeries
+		detached, queuedCounts, abandonedCounts = previousDetached, previousQueued, previousAbandoned
+		endedSessions = previousEnded
+	})
+
+	routes = make(map[string]Route)
+	for name, route := range configured {
+		routes[name] = route
+	}
+	tables = make(map[string]Table)
+	service_vwr_room_table, service_vwr_user_table = "room", "user"
+	sortedEntries = make(map[string]*Lane)
+	priorityLanes = make(map[string]map[string]*Lane)
+	laneCurrent = make(map[string]map[string]int)
+	preQueue = make(map[string]*Lane)
+	eventStates = make(map[string]int)
+	admissionCredits = make(map[string]float64)
+	bypassSessions = make(map[string]string)
+	queuedSince = make(map[string]queuedSession)
+	counters = make(map[string]*routeCounters)
+	series = make(map[string]*Series)
+	detached = make(map[string]detachedSession)
+	queuedCounts = make(map[string]int)
+	abandonedCounts = make(map[string]int)
+
+	clock := newFakeClock()
+	sessions = newExpiryScheduler(clock, onSessionRemove)
+	endedSessions = newExpiryScheduler(clock, func(string, string, RemovalReason) {})
+	initRoomTable()
+	tables[service_vwr_user_table] = Table{
+		definition: TableDefinition{Name: service_vwr_user_table, KeyType: STRING, DataTypes: []int{GPC1}},
+		entries:    make(map[string]Entry),
+	}
+	return clock
+}
+
+// queueSession reports a new session of a route the way HAProxy does and
+// returns its key
+func queueSession(name string, sid string) string {
+	id, keyEnc := sessionKey(sid, name)
+	tables[service_vwr_user_table].entries[keyEnc] = Entry{Key: id, Values: map[int][]int{GPC1: {0}}}
+	enqueue(name, keyEnc)
+	return keyEnc
+}
+
+func admitted(keyEnc string) bool {
+	entry, exists := tables[service_vwr_user_table].entries[keyEnc]
+	return exists && entry.Values[GPC1][0] == 1
+}
+
+func freeSlots(name string) int {
+	key := []byte(name)
+	jsonKey, _ := json.Marshal(&key)
+	roomEnc := b64.StdEncoding.EncodeToString(jsonKey)
+	return tables[service_vwr_room_table].entries[roomEnc].Values[GPC0][0]
+}
+
+func TestRefillRoomIgnoresBypass(t *testing.T) {
+	withRoomState(t, map[string]Route{"shop": {HOST: "shop.example.com", PATH: "/", TOTAL_ACTIVE_USERS: 2}})
+
+	id, keyEnc := sessionKey("staff", "shop")
+	grantSlot("shop", id, keyEnc)
+	_, admittedEnc := sessionKey("visitor", "shop")
+	touchSession(admittedEnc, "shop")
+	waiting := queueSession("shop", "waiting")
+
+	refillRoom("shop", routes["shop"])
+	if !admitted(waiting) {
+		t.Errorf("the slot not held by the admitted visitor was not handed to the queue")
+	}
+	if slots := freeSlots("shop"); slots != 0 {
+		t.Errorf("%d free slots, want 0", slots)
+	}
+
+	sessions.Remove(keyEnc)
+	if _, exists := bypassSessions[keyEnc]; exists {
+		t.Errorf("the bypass session outlived its removal")
+	}
+	if slots := freeSlots("shop"); slots != 0 {
+		t.Errorf("the end of the bypass session freed a slot")
+	}
+}
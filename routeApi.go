@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const ROUTES_API = "/api/v1/routes"
+
+// route names end up in file paths of the template directory, they never
+// start with a dot
+var routeNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]{0,31}$`)
+var routeHostPattern = regexp.MustCompile(`^[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)*$`)
+var routePathPattern = regexp.MustCompile(`^/[^\s{}]*$`)
+
+func validateRoute(name string, route Route) error {
+	if !routeNamePattern.MatchString(name) {
+		return errors.New("name must be 1 to 32 letters, digits, '_', '.' or '-' and must not start with '.'")
+	}
+	if err := validateMatch(route); err != nil {
+		return err
+	}
+	if route.HOST != "" && !routeHostPattern.MatchString(route.HOST) {
+		return errors.New("host must be a domain name or an IP address")
+	}
+	if route.TOTAL_ACTIVE_USERS < 0 || route.SESSION_DURATION < 0 || route.MAX_QUEUE_LENGTH < 0 || route.ADMISSION_RATE < 0 || route.ABANDON_GRACE < 0 || route.IP_LIMIT < 0 || route.PREFIX_LIMIT < 0 || route.QUEUE_THRESHOLD < 0 {
+		return errors.New("numeric settings must not be negative")
+	}
+	if route.ADMISSION_MODE != "" && route.ADMISSION_MODE != ADMISSION_CONCURRENCY && route.ADMISSION_MODE != ADMISSION_RATE {
+		return fmt.Errorf("admission mode must be %s or %s", ADMISSION_CONCURRENCY, ADMISSION_RATE)
+	}
+	if route.POW_DIFFICULTY < 0 || route.POW_DIFFICULTY > MAX_POW_DIFFICULTY {
+		return fmt.Errorf("proof-of-work difficulty must be between 0 and %d", MAX_POW_DIFFICULTY)
+	}
+	for lane, weight := range route.LANES {
+		if weight < 1 {
+			return fmt.Errorf("weight of lane %s must be positive", lane)
+		}
+	}
+	if route.AUTOSCALE != nil {
+		if err := route.AUTOSCALE.validate(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range append(append([]AccessRule{}, route.BYPASS...), route.DENY...) {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	if route.TEMPLATE != "" && filepath.Base(route.TEMPLATE) != route.TEMPLATE {
+		return errors.New("template must be a file name of the template directory")
+	}
+	if route.FULL_PAGE != "" && filepath.Base(route.FULL_PAGE) != route.FULL_PAGE {
+		return errors.New("full page must be a file name of the template directory")
+	}
+	if !route.EVENT_START.IsZero() && !route.EVENT_END.IsZero() && !route.EVENT_END.After(route.EVENT_START) {
+		return errors.New("event end must be after event start")
+	}
+	return nil
+}
+
+// copy returns the route with its own lanes, rules and autoscaling so that
+// decoding into it leaves the live route alone
+func (route Route) copy() Route {
+	if route.LANES != nil {
+		lanes := make(map[string]int)
+		for lane, weight := range route.LANES {
+			lanes[lane] = weight
+		}
+		route.LANES = lanes
+	}
+	if route.AUTOSCALE != nil {
+		autoscale := *route.AUTOSCALE
+		route.AUTOSCALE = &autoscale
+	}
+	if route.BYPASS != nil {
+		route.BYPASS = append([]AccessRule{}, route.BYPASS...)
+	}
+	if route.DENY != nil {
+		route.DENY = append([]AccessRule{}, route.DENY...)
+	}
+	return route
+}
+
+// saveRoute validates a route and puts it in place of the current one
+func saveRoute(name string, route Route) error {
+	if err := validateRoute(name, route); err != nil {
+		return err
+	}
+	updateRoomTable(name, route)
+	sendRouteUpdate()
+	warnUntrustedProxies(name, route)
+	return nil
+}
+
+// handleRoutes serves GET on the collection and GET, PUT, PATCH and DELETE
+// on /api/v1/routes/{name}
+func handleRoutes(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, ROUTES_API), "/")
+
+	if name == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, routes)
+		return
+	}
+
+	route, exists := routes[name]
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			http.Error(w, "Unknown route", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, route)
+	case http.MethodPut, http.MethodPatch:
+		if r.Method == http.MethodPatch && !exists {
+			http.Error(w, "Unknown route", http.StatusNotFound)
+			return
+		}
+		current := route
+		if r.Method == http.MethodPut {
+			route = Route{STATE: current.STATE, CLOSED: current.CLOSED}
+		} else {
+			route = route.copy()
+		}
+
+		// PATCH decodes over the current route, keys left out keep their value
+		if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+			http.Error(w, "Error decoding JSON request body", http.StatusBadRequest)
+			return
+		}
+		if route.STATE != current.STATE || route.CLOSED != current.CLOSED {
+			http.Error(w, "vwr_state and vwr_closed change through /pause, /resume, /drain and /close", http.StatusBadRequest)
+			return
+		}
+		if err := saveRoute(name, route); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("route %s updated through the API\n", name)
+
+		status := http.StatusOK
+		if !exists {
+			status = http.StatusCreated
+		}
+		writeJSON(w, status, routes[name])
+	case http.MethodDelete:
+		if !deleteRoomTable(name) {
+			http.Error(w, "Unknown route", http.StatusNotFound)
+			return
+		}
+		log.Printf("route %s deleted through the API\n", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Println("Error encoding JSON response:", err)
+	}
+}
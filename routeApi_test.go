@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPatchRejectedKeepsRoute(t *testing.T) {
+	live := Route{
+		TOTAL_ACTIVE_USERS: 20,
+		PATH:               "/shop",
+		LANES:              map[string]int{"vip": 3},
+		AUTOSCALE:          &Autoscale{TABLE: "backend", SIGNAL: "conn_cur", HIGH: 100, LOW: 10, MIN: 5, MAX: 50},
+		BYPASS:             []AccessRule{{CIDR: "10.0.0.0/8"}},
+		DENY:               []AccessRule{{HEADER: "X-Bot", VALUE: "1"}},
+	}
+	want := live.copy()
+
+	previous := routes
+	routes = map[string]Route{"shop": live}
+	t.Cleanup(func() {
+		routes = previous
+	})
+
+	bodies := []string{
+		`{"vwr_autoscale":{"max":-1}}`,
+		`{"vwr_lanes":{"vip":1,"staff":2},"vwr_active_users":-1}`,
+		`{"vwr_bypass":[{"cidr":"not a network"}]}`,
+		`{"vwr_deny":[{"header":"X-Bot","value":"2"},{"cidr":"bad"}]}`,
+	}
+	for _, body := range bodies {
+		request := httptest.NewRequest(http.MethodPatch, ROUTES_API+"/shop", strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		handleRoutes(recorder, request)
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("PATCH %s: status %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+		if got := routes["shop"]; !reflect.DeepEqual(got, want) {
+			t.Errorf("PATCH %s changed the live route to %+v", body, got)
+		}
+	}
+}
+
+func routeRequest(method string, name string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, ROUTES_API+"/"+name, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	handleRoutes(recorder, request)
+	return recorder
+}
+
+func TestPutCreatesRoute(t *testing.T) {
+	withRoomState(t, map[string]Route{})
+
+	recorder := routeRequest(http.MethodPut, "shop", `{"host":"shop.example.com","path":"/","vwr_active_users":3}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("PUT: status %d, want %d: %s", recorder.Code, http.StatusCreated, recorder.Body)
+	}
+	if route := routes["shop"]; route.HOST != "shop.example.com" || route.TOTAL_ACTIVE_USERS != 3 {
+		t.Errorf("PUT stored %+v", route)
+	}
+	if slots := freeSlots("shop"); slots != 3 {
+		t.Errorf("new route has %d free slots, want 3", slots)
+	}
+
+	recorder = routeRequest(http.MethodPut, "shop", `{"host":"shop.example.com","path":"/","vwr_active_users":5}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("PUT on an existing route: status %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if slots := freeSlots("shop"); slots != 5 {
+		t.Errorf("replaced route has %d free slots, want 5", slots)
+	}
+}
+
+func TestPatchRefillsSlots(t *testing.T) {
+	withRoomState(t, map[string]Route{"shop": {HOST: "shop.example.com", PATH: "/", TOTAL_ACTIVE_USERS: 2}})
+
+	// the two slots are taken and three visitors wait
+	setRoomSlots("shop", 0)
+	waiting := []string{queueSession("shop", "a"), queueSession("shop", "b"), queueSession("shop", "c")}
+
+	recorder := routeRequest(http.MethodPatch, "shop", `{"vwr_active_users":4}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("PATCH: status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+	if !admitted(waiting[0]) || !admitted(waiting[1]) || admitted(waiting[2]) {
+		t.Errorf("the two new slots did not go to the head of the queue")
+	}
+	if length := queueLength("shop"); length != 1 {
+		t.Errorf("%d visitors still wait, want 1", length)
+	}
+	if slots := freeSlots("shop"); slots != 0 {
+		t.Errorf("%d free slots, want 0", slots)
+	}
+
+	routeRequest(http.MethodPatch, "shop", `{"vwr_active_users":6}`)
+	if !admitted(waiting[2]) {
+		t.Errorf("the last visitor was not admitted")
+	}
+	if slots := freeSlots("shop"); slots != 1 {
+		t.Errorf("%d free slots, want 1", slots)
+	}
+
+	routeRequest(http.MethodPatch, "shop", `{"vwr_active_users":3}`)
+	if slots := freeSlots("shop"); slots != 0 {
+		t.Errorf("shrinking below the active visitors left %d free slots", slots)
+	}
+}
+
+func TestPutRejected(t *testing.T) {
+	withRoomState(t, map[string]Route{})
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"shop", `{"path":"/","vwr_state":"paused"}`},
+		{"shop", `{"path":"/","vwr_closed":true}`},
+		{"..", `{"path":"/"}`},
+		{".hidden", `{"path":"/"}`},
+	}
+	for _, test := range tests {
+		recorder := routeRequest(http.MethodPut, test.name, test.body)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s %s: status %d, want %d", test.name, test.body, recorder.Code, http.StatusBadRequest)
+		}
+		if _, exists := routes[test.name]; exists {
+			t.Errorf("PUT %s %s created the route", test.name, test.body)
+		}
+	}
+}
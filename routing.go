@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	MATCH_PREFIX = "prefix"
+	MATCH_EXACT  = "exact"
+	MATCH_REGEX  = "regex"
+)
+
+func (route Route) matchMode() string {
+	if route.MATCH == MATCH_EXACT || route.MATCH == MATCH_REGEX {
+		return route.MATCH
+	}
+	return MATCH_PREFIX
+}
+
+// basePath is the path the pages of the route live under, regex routes can
+// only be narrowed to the whole site
+func (route Route) basePath() string {
+	if route.matchMode() == MATCH_REGEX {
+		return "/"
+	}
+	return route.PATH
+}
+
+// matches tells if a request for host and path belongs to the route, routes
+// without host match every host. Hosts and paths are compared ignoring case
+// like the -i matches of HAProxy.
+func (route Route) matches(host string, path string) bool {
+	if route.HOST != "" && !strings.EqualFold(route.HOST, host) {
+		return false
+	}
+
+	switch route.matchMode() {
+	case MATCH_EXACT:
+		return strings.EqualFold(path, route.PATH)
+	case MATCH_REGEX:
+		pattern := rulePattern("(?i)" + route.PATH)
+		return pattern != nil && pattern.MatchString(path)
+	}
+	return len(path) >= len(route.PATH) && strings.EqualFold(path[:len(route.PATH)], route.PATH)
+}
+
+// routeOrder returns the route names from the most to the least specific:
+// routes with a host first, then exact paths, the longest prefixes and
+// finally regular expressions. HAProxy and lineq both give a request to the
+// first route of this order that matches it.
+func routeOrder(routes map[string]Route) []string {
+	rank := map[string]int{MATCH_EXACT: 0, MATCH_PREFIX: 1, MATCH_REGEX: 2}
+
+	names := make([]string, 0, len(routes))
+	for name := range routes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := routes[names[i]], routes[names[j]]
+		if (a.HOST == "") != (b.HOST == "") {
+			return a.HOST != ""
+		}
+		if rank[a.matchMode()] != rank[b.matchMode()] {
+			return rank[a.matchMode()] < rank[b.matchMode()]
+		}
+		if a.matchMode() == MATCH_PREFIX && len(a.PATH) != len(b.PATH) {
+			return len(a.PATH) > len(b.PATH)
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// matchRoute returns the name of the route of a request for host and path
+func matchRoute(host string, path string) (string, bool) {
+	for _, name := range routeOrder(routes) {
+		if routes[name].matches(host, path) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func validateMatch(route Route) error {
+	switch route.MATCH {
+	case "", MATCH_PREFIX, MATCH_EXACT:
+		if !routePathPattern.MatchString(route.PATH) {
+			return errors.New("path must start with '/' and contain no spaces or braces")
+		}
+	case MATCH_REGEX:
+		if route.PATH == "" || strings.ContainsAny(route.PATH, " \t{}") {
+			return errors.New("path pattern must not be empty or contain spaces or braces")
+		}
+		if _, err := regexp.Compile(route.PATH); err != nil {
+			return fmt.Errorf("invalid path pattern %s", route.PATH)
+		}
+	default:
+		return fmt.Errorf("match must be %s, %s or %s", MATCH_PREFIX, MATCH_EXACT, MATCH_REGEX)
+	}
+	return nil
+}
+
+// haproxyMatch is the HAProxy condition of the requests of the route, on the
+// txn.host and txn.path variables of the frontend
+func (route Route) haproxyMatch() string {
+	condition := ""
+	if route.HOST != "" {
+		condition += fmt.Sprintf("{ var(txn.host) -m str -i %s } ", route.HOST)
+	}
+
+	switch route.matchMode() {
+	case MATCH_EXACT:
+		condition += fmt.Sprintf("{ var(txn.path) -i -m str %s }", route.PATH)
+	case MATCH_REGEX:
+		condition += fmt.Sprintf("{ var(txn.path) -i -m reg %s }", route.PATH)
+	default:
+		condition += fmt.Sprintf("{ var(txn.path) -i -m beg %s }", route.PATH)
+	}
+	return condition
+}
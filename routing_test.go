@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRouteOrder(t *testing.T) {
+	configured := map[string]Route{
+		"any":      {PATH: "/"},
+		"sale":     {PATH: "/shop/sale"},
+		"checkout": {PATH: "/shop/checkout", MATCH: MATCH_EXACT},
+		"images":   {PATH: `^/shop/.*\.png$`, MATCH: MATCH_REGEX},
+		"shop":     {PATH: "/shop"},
+		"alpha":    {PATH: "/shop"},
+		"host":     {HOST: "shop.example.com", PATH: "/"},
+		"hostsale": {HOST: "shop.example.com", PATH: "/sale"},
+	}
+	want := []string{"hostsale", "host", "checkout", "sale", "alpha", "shop", "any", "images"}
+	for i := 0; i < 20; i++ {
+		if got := routeOrder(configured); !reflect.DeepEqual(got, want) {
+			t.Fatalf("routeOrder() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	withRoomState(t, map[string]Route{
+		"any":      {PATH: "/"},
+		"shop":     {PATH: "/shop"},
+		"checkout": {PATH: "/shop/checkout", MATCH: MATCH_EXACT},
+		"images":   {PATH: `^/shop/.*\.png$`, MATCH: MATCH_REGEX},
+		"blog":     {HOST: "blog.example.com", PATH: "/"},
+	})
+
+	tests := []struct {
+		host string
+		path string
+		want string
+	}{
+		{"www.example.com", "/", "any"},
+		{"www.example.com", "/shop/cart", "shop"},
+		{"www.example.com", "/Shop/cart", "shop"},
+		{"www.example.com", "/SHOP", "shop"},
+		{"www.example.com", "/sho", "any"},
+		{"www.example.com", "/shop/checkout", "checkout"},
+		{"www.example.com", "/shop/Checkout", "checkout"},
+		{"www.example.com", "/shop/checkout/", "shop"},
+		{"www.example.com", "/shop/logo.PNG", "shop"},
+		{"www.example.com", "/logo.png", "any"},
+		{"blog.example.com", "/shop", "blog"},
+		{"Blog.Example.com", "/", "blog"},
+	}
+	for _, test := range tests {
+		name, exists := matchRoute(test.host, test.path)
+		if !exists || name != test.want {
+			t.Errorf("matchRoute(%q, %q) = %q, want %q", test.host, test.path, name, test.want)
+		}
+	}
+
+	// a regex route behind no prefix route takes its paths in any case
+	delete(routes, "any")
+	delete(routes, "shop")
+	if name, _ := matchRoute("www.example.com", "/Shop/logo.PNG"); name != "images" {
+		t.Errorf("matchRoute() = %q, want images", name)
+	}
+	if _, exists := matchRoute("www.example.com", "/blog"); exists {
+		t.Errorf("a request without route matched one")
+	}
+}
+
+func TestHaproxyMatch(t *testing.T) {
+	tests := []struct {
+		route Route
+		want  string
+	}{
+		{Route{PATH: "/shop"}, "{ var(txn.path) -i -m beg /shop }"},
+		{Route{PATH: "/shop/checkout", MATCH: MATCH_EXACT}, "{ var(txn.path) -i -m str /shop/checkout }"},
+		{Route{PATH: `^/shop/.*\.png$`, MATCH: MATCH_REGEX}, `{ var(txn.path) -i -m reg ^/shop/.*\.png$ }`},
+		{Route{HOST: "shop.example.com", PATH: "/"}, "{ var(txn.host) -m str -i shop.example.com } { var(txn.path) -i -m beg / }"},
+	}
+	for _, test := range tests {
+		if got := test.route.haproxyMatch(); got != test.want {
+			t.Errorf("haproxyMatch() of %+v = %q, want %q", test.route, got, test.want)
+		}
+	}
+
+	// HAProxy sets txn.route in the same order lineq matches routes
+	withSessionKeys(t, nil, 60)
+	configured := map[string]Route{"shop": {PATH: "/shop"}, "any": {PATH: "/"}}
+	config := generatedConfig(t, configured)
+	want := []string{}
+	for _, name := range []string{"shop", "any"} {
+		want = append(want, fmt.Sprintf("\thttp-request set-var(txn.route) str(%s) if !{ var(txn.route) -m found } %s", name, configured[name].haproxyMatch()))
+	}
+	if !linesInOrder(config, want) {
+		t.Errorf("the generated configuration does not set the routes in order %v", want)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SESSION_COOKIE = "lineq_session"
+const SESSION_HEADER = "X-Lineq-Session"
+
+// session tokens are key id.sid.issued.signature, with the longest key id
+// they stay below MAX_SESSION_ID_LEN so that they fit in user table keys
+const MAX_SESSION_KEY_ID_LEN = 16
+const SESSION_ID_BYTES = 16
+const SESSION_SIGNATURE_BYTES = 16
+
+var sessionKeyIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,16}$`)
+
+type SessionKey struct {
+	ID     string `json:"id"`
+	SECRET string `json:"secret"`
+}
+
+// the first key signs new session tokens, every key is accepted when
+// verifying so that keys can be rotated without dropping waiting visitors
+var service_vwr_session_keys []SessionKey
+var service_vwr_session_token_ttl int
+
+func validateSessionKeys(keys []SessionKey) error {
+	for _, key := range keys {
+		if !sessionKeyIdPattern.MatchString(key.ID) {
+			return fmt.Errorf("session key id %q must be 1 to %d letters, digits, '_' or '-'", key.ID, MAX_SESSION_KEY_ID_LEN)
+		}
+		if key.SECRET == "" {
+			return fmt.Errorf("session key %s has no secret", key.ID)
+		}
+	}
+	return nil
+}
+
+func sessionSignature(secret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return b64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:SESSION_SIGNATURE_BYTES])
+}
+
+// sessionCookie is the name of the cookie holding the session of a route,
+// HAProxy tracks the visitors of the route by its value
+func sessionCookie(name string) string {
+	return SESSION_COOKIE + "_" + name
+}
+
+// newSessionId draws the id of a new visitor, lineq never signs an id it
+// did not draw itself
+func newSessionId() string {
+	id := make([]byte, SESSION_ID_BYTES)
+	rand.Read(id)
+	return b64.RawURLEncoding.EncodeToString(id)
+}
+
+// signSession binds a session id to a route and an issue time, the token is
+// key id.sid.issued.signature where the signature covers the route as well
+func signSession(sid string, name string, issued time.Time) string {
+	key := service_vwr_session_keys[0]
+	payload := key.ID + "." + sid + "." + strconv.FormatInt(issued.Unix(), 36)
+	return payload + "." + sessionSignature(key.SECRET, payload+"."+name)
+}
+
+// verifySession checks a token of a route, the whole token is the queue
+// identity of the visitor
+func verifySession(token string, name string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return "", errors.New("malformed session")
+	}
+
+	var key *SessionKey
+	for i := range service_vwr_session_keys {
+		if service_vwr_session_keys[i].ID == parts[0] {
+			key = &service_vwr_session_keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return "", errors.New("unknown session key")
+	}
+
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(sessionSignature(key.SECRET, payload+"."+name))) {
+		return "", errors.New("invalid session signature")
+	}
+
+	issued, err := strconv.ParseInt(parts[2], 36, 64)
+	if err != nil {
+		return "", errors.New("malformed session")
+	}
+	if time.Since(time.Unix(issued, 0)) > time.Duration(service_vwr_session_token_ttl)*time.Minute {
+		return "", errors.New("expired session")
+	}
+	return token, nil
+}
+
+func signedSessions() bool {
+	return len(service_vwr_session_keys) > 0
+}
+
+// signedSession returns the valid session of a route the request carries
+func signedSession(r *http.Request, name string) (string, error) {
+	err := errors.New("missing session")
+	for _, cookie := range r.Cookies() {
+		if cookie.Name != sessionCookie(name) {
+			continue
+		}
+		var token string
+		if token, err = verifySession(cookie.Value, name); err == nil {
+			return token, nil
+		}
+	}
+	return "", err
+}
+
+// issueSessionCookie hands a visitor without a valid session of the route a
+// new one. The session id is drawn by lineq and a valid cookie is never
+// signed again, so that it expires after vwr_session_token_ttl.
+func issueSessionCookie(w http.ResponseWriter, r *http.Request) {
+	if !signedSessions() {
+		return
+	}
+
+	hostname := r.Host
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		hostname = host
+	}
+	name := queueName(hostname, r.URL.Path)
+	if name == "" {
+		return
+	}
+	if _, err := signedSession(r, name); err == nil {
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     sessionCookie(name),
+		Value:    signSession(newSessionId(), name, time.Now()),
+		Path:     "/",
+		MaxAge:   service_vwr_session_token_ttl * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, cookie)
+	// the page served for this request already belongs to the new session
+	r.AddCookie(cookie)
+}
+
+// sessionId returns the queue identity of an SSE request, with signed
+// sessions it only trusts the session cookie of the route
+func sessionId(r *http.Request, cookie string, name string) (string, error) {
+	if !signedSessions() {
+		return cookieValue(cookie, "sessionid"), nil
+	}
+	return signedSession(r, name)
+}
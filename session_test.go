@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withSessionKeys(t *testing.T, keys []SessionKey, ttl int) {
+	previousKeys, previousTTL := service_vwr_session_keys, service_vwr_session_token_ttl
+	service_vwr_session_keys, service_vwr_session_token_ttl = keys, ttl
+	t.Cleanup(func() {
+		service_vwr_session_keys, service_vwr_session_token_ttl = previousKeys, previousTTL
+	})
+}
+
+func TestVerifySession(t *testing.T) {
+	withSessionKeys(t, []SessionKey{{ID: "new", SECRET: "s1"}, {ID: "old", SECRET: "s0"}}, 60)
+
+	token := signSession(newSessionId(), "shop", time.Now())
+	if len(token) > MAX_SESSION_ID_LEN {
+		t.Errorf("token %s is longer than %d bytes", token, MAX_SESSION_ID_LEN)
+	}
+	if _, err := verifySession(token, "shop"); err != nil {
+		t.Errorf("valid token rejected: %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	tests := []struct {
+		name  string
+		token string
+		route string
+	}{
+		{"other route", token, "tickets"},
+		{"forged sid", parts[0] + ".chosen." + parts[2] + "." + parts[3], "shop"},
+		{"unknown key", "gone." + strings.Join(parts[1:], "."), "shop"},
+		{"malformed", "chosen", "shop"},
+		{"expired", signSession(newSessionId(), "shop", time.Now().Add(-61*time.Minute)), "shop"},
+	}
+	for _, test := range tests {
+		if _, err := verifySession(test.token, test.route); err == nil {
+			t.Errorf("%s: token accepted", test.name)
+		}
+	}
+
+	// tokens of a rotated key stay valid
+	service_vwr_session_keys = service_vwr_session_keys[1:]
+	if _, err := verifySession(signSession(newSessionId(), "shop", time.Now()), "shop"); err != nil {
+		t.Errorf("token of the old key rejected: %v", err)
+	}
+}
+
+func TestIssueSessionCookie(t *testing.T) {
+	withSessionKeys(t, []SessionKey{{ID: "k", SECRET: "secret"}}, 60)
+	withCatalogs(t, catalogs, map[string]Route{"shop": {HOST: "shop.example.com", PATH: "/"}})
+
+	request := httptest.NewRequest(http.MethodGet, "http://shop.example.com/cart", nil)
+	request.AddCookie(&http.Cookie{Name: "sessionid", Value: "chosen"})
+	recorder := httptest.NewRecorder()
+	issueSessionCookie(recorder, request)
+
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie("shop") {
+		t.Fatalf("cookies %v, want one %s cookie", cookies, sessionCookie("shop"))
+	}
+	if strings.Contains(cookies[0].Value, "chosen") {
+		t.Errorf("client supplied sid signed: %s", cookies[0].Value)
+	}
+	if sid := requestSid(request, "shop"); sid != cookies[0].Value {
+		t.Errorf("page session %q, want the issued %q", sid, cookies[0].Value)
+	}
+
+	// a valid session is never signed again, so that it expires
+	again := httptest.NewRequest(http.MethodGet, "http://shop.example.com/cart", nil)
+	again.AddCookie(cookies[0])
+	recorder = httptest.NewRecorder()
+	issueSessionCookie(recorder, again)
+	if reissued := recorder.Result().Cookies(); len(reissued) != 0 {
+		t.Errorf("valid session signed again: %v", reissued)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const QUEUE_API = "/api/v1/queue"
+const MAX_POLL_WAIT = 60
+
+const (
+	VISITOR_QUEUED   = "queued"
+	VISITOR_ADMITTED = "admitted"
+	VISITOR_PENDING  = "pending"
+	VISITOR_UNKNOWN  = "unknown"
+	VISITOR_EXPIRED  = "expired"
+)
+
+// VisitorStatus is the queue status served to native apps, Redirect is where
+// the app sends the visitor once admitted
+type VisitorStatus struct {
+	State    string `json:"state"`
+	Redirect string `json:"redirect,omitempty"`
+	QueueStatus
+}
+
+// redirect returns the page visitors go to once admitted
+func (route Route) redirect() string {
+	if route.REDIRECT != "" {
+		return route.REDIRECT
+	}
+	if route.HOST != "" {
+		return "https://" + route.HOST + route.basePath()
+	}
+	return route.basePath()
+}
+
+// visitorStatus tells where a session stands: queued, admitted, pending while
+// it solves its challenge or before it enters the queue, expired once lineq
+// let go of it and unknown while HAProxy did not report it
+func visitorStatus(name string, keyEnc string) VisitorStatus {
+	status := VisitorStatus{
+		State:       VISITOR_UNKNOWN,
+		QueueStatus: queueStatus(name, keyEnc),
+	}
+
+	entry, reported := tables[service_vwr_user_table].entries[keyEnc]
+	switch {
+	case isQueued(name, keyEnc):
+		status.State = VISITOR_QUEUED
+	case reported && len(entry.Values[GPC1]) > 0 && entry.Values[GPC1][0] == 1:
+		status.State = VISITOR_ADMITTED
+		status.Redirect = routes[name].redirect()
+	case routeClosed(name):
+		status.State = VISITOR_EXPIRED
+	case heldForChallenge(name, keyEnc) || reported:
+		status.State = VISITOR_PENDING
+	case endedSessions.Contains(keyEnc):
+		status.State = VISITOR_EXPIRED
+	}
+	return status
+}
+
+// waiting tells if the visitor may still be admitted, the polls and streams
+// go on until it is not
+func (status VisitorStatus) waiting() bool {
+	return status.State == VISITOR_QUEUED || status.State == VISITOR_PENDING || status.State == VISITOR_UNKNOWN
+}
+
+// currentStatus reads the status of a session for the polls and streams,
+// which do not hold the room while they wait
+func currentStatus(name string, keyEnc string) VisitorStatus {
+	roomMutex.Lock()
+	defer roomMutex.Unlock()
+
+	return visitorStatus(name, keyEnc)
+}
+
+// apiSessionId returns the queue identity of an app request, the session
+// token comes as a bearer token or in the session query parameter and is
+// verified like the session cookie of the route when signed sessions are
+// enabled
+func apiSessionId(r *http.Request, name string) (string, error) {
+	token := r.URL.Query().Get("session")
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	if token == "" {
+		return "", errors.New("missing session")
+	}
+
+	if !signedSessions() {
+		return token, nil
+	}
+	return verifySession(token, name)
+}
+
+// handleQueueStatus serves GET /api/v1/queue?route=name. With wait=seconds
+// it answers as soon as the position differs from the given position, or
+// after the wait, and /api/v1/queue/stream streams the status as SSE.
+func handleQueueStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("route")
+	roomMutex.Lock()
+	_, exists := routes[name]
+	roomMutex.Unlock()
+	if !exists {
+		http.Error(w, "Unknown route", http.StatusNotFound)
+		return
+	}
+
+	sid, err := apiSessionId(r, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	_, keyEnc := sessionKey(sid, name)
+
+	if strings.TrimSuffix(r.URL.Path, "/") == QUEUE_API+"/stream" {
+		streamQueueStatus(w, r, name, keyEnc)
+		return
+	}
+
+	var status VisitorStatus
+	withRoom(func() {
+		sessionSeen(name, keyEnc)
+		status = visitorStatus(name, keyEnc)
+	})
+	wait, err := strconv.Atoi(r.URL.Query().Get("wait"))
+	if err == nil && wait > 0 && status.waiting() {
+		if wait > MAX_POLL_WAIT {
+			wait = MAX_POLL_WAIT
+		}
+		position, err := strconv.Atoi(r.URL.Query().Get("position"))
+		if err != nil {
+			position = status.Position
+		}
+		status = pollQueueStatus(r, name, keyEnc, status.State, position, time.Duration(wait)*time.Second)
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, http.StatusOK, status)
+}
+
+// pollQueueStatus waits for the state or the position of a session to move
+// away from the ones the app already knows
+func pollQueueStatus(r *http.Request, name string, keyEnc string, state string, position int, wait time.Duration) VisitorStatus {
+	subscription := subscribe(name, keyEnc)
+	defer withRoom(func() {
+		unsubscribe(subscription)
+	})
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	for {
+		status := currentStatus(name, keyEnc)
+		if status.State != state || status.Position != position {
+			return status
+		}
+
+		select {
+		case <-subscription.messages:
+		case <-timeout.C:
+			return status
+		case <-r.Context().Done():
+			return status
+		}
+	}
+}
+
+func streamQueueStatus(w http.ResponseWriter, r *http.Request, name string, keyEnc string) {
+	subscription := subscribe(name, keyEnc)
+	defer withRoom(func() {
+		unsubscribe(subscription)
+	})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ticker := time.NewTicker(STATUS_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		status := currentStatus(name, keyEnc)
+		fmt.Fprint(w, sseFrame("status", status.String()))
+		w.(http.Flusher).Flush()
+		if !status.waiting() {
+			return
+		}
+
+		select {
+		case <-subscription.messages:
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (status VisitorStatus) String() string {
+	data, _ := json.Marshal(status)
+	return string(data)
+}
@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestVisitorStatus(t *testing.T) {
+	clock := withRoomState(t, map[string]Route{
+		"shop":  {HOST: "shop.example.com", PATH: "/", TOTAL_ACTIVE_USERS: 1},
+		"drops": {HOST: "drops.example.com", PATH: "/", POW_DIFFICULTY: 4},
+	})
+	withChallenges(t)
+
+	state := func(name string, keyEnc string) string {
+		return visitorStatus(name, keyEnc).State
+	}
+
+	_, unreported := sessionKey("unreported", "shop")
+	if got := state("shop", unreported); got != VISITOR_UNKNOWN {
+		t.Errorf("a session HAProxy did not report is %s", got)
+	}
+
+	held := queueSession("drops", "held")
+	if got := state("drops", held); got != VISITOR_PENDING {
+		t.Errorf("a session held for its challenge is %s", got)
+	}
+	releaseSession("drops", held)
+	if got := state("drops", held); got != VISITOR_QUEUED {
+		t.Errorf("a session that solved its challenge is %s", got)
+	}
+
+	id, reported := sessionKey("reported", "shop")
+	tables[service_vwr_user_table].entries[reported] = Entry{Key: id, Values: map[int][]int{GPC1: {0}}}
+	if got := state("shop", reported); got != VISITOR_PENDING {
+		t.Errorf("a reported session outside the queue is %s", got)
+	}
+
+	first, second := queueSession("shop", "first"), queueSession("shop", "second")
+	refillRoom("shop", routes["shop"])
+	status := visitorStatus("shop", first)
+	if status.State != VISITOR_ADMITTED || status.Redirect != "https://shop.example.com/" {
+		t.Errorf("the admitted session is %+v", status)
+	}
+	if got := state("shop", second); got != VISITOR_QUEUED {
+		t.Errorf("the waiting session is %s", got)
+	}
+
+	// the slot of the first session goes to the second one
+	sessions.Remove(first)
+	if got := state("shop", first); got != VISITOR_EXPIRED {
+		t.Errorf("an ended session is %s", got)
+	}
+	if got := state("shop", second); got != VISITOR_ADMITTED {
+		t.Errorf("the next session is %s", got)
+	}
+
+	clock.Advance(ENDED_SESSION_TTL)
+	endedSessions.Expire()
+	if got := state("shop", first); got != VISITOR_UNKNOWN {
+		t.Errorf("a session ended long ago is %s", got)
+	}
+
+	route := routes["shop"]
+	route.CLOSED = true
+	routes["shop"] = route
+	if got := state("shop", reported); got != VISITOR_EXPIRED {
+		t.Errorf("a session of a closed route is %s", got)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+)
+
+const SUBSCRIPTION_BUFFER = 16
+
+// Subscription is the SSE stream of one visitor page, indexed by route and
+// session so that only the waiters of a route hear about its admissions
+type Subscription struct {
+	route    string
+	keyEnc   string
+	messages chan string
+	position int
+}
+
+var subscriptions = make(map[string]map[string]map[*Subscription]bool)
+var subscriptionsMutex sync.Mutex
+
+func subscribe(name string, keyEnc string) *Subscription {
+	defer streamOpened(keyEnc)
+
+	subscriptionsMutex.Lock()
+	defer subscriptionsMutex.Unlock()
+
+	subscription := &Subscription{
+		route:    name,
+		keyEnc:   keyEnc,
+		messages: make(chan string, SUBSCRIPTION_BUFFER),
+		position: -1,
+	}
+	if _, exists := subscriptions[name]; !exists {
+		subscriptions[name] = make(map[string]map[*Subscription]bool)
+	}
+	if _, exists := subscriptions[name][keyEnc]; !exists {
+		subscriptions[name][keyEnc] = make(map[*Subscription]bool)
+	}
+	subscriptions[name][keyEnc][subscription] = true
+	return subscription
+}
+
+func unsubscribe(subscription *Subscription) {
+	subscriptionsMutex.Lock()
+	sessionSubscriptions := subscriptions[subscription.route][subscription.keyEnc]
+	delete(sessionSubscriptions, subscription)
+	last := len(sessionSubscriptions) == 0
+	if last {
+		delete(subscriptions[subscription.route], subscription.keyEnc)
+	}
+	if len(subscriptions[subscription.route]) == 0 {
+		delete(subscriptions, subscription.route)
+	}
+	subscriptionsMutex.Unlock()
+
+	if last {
+		streamClosed(subscription.route, subscription.keyEnc)
+	}
+}
+
+func hasSubscription(name string, keyEnc string) bool {
+	subscriptionsMutex.Lock()
+	defer subscriptionsMutex.Unlock()
+
+	return len(subscriptions[name][keyEnc]) > 0
+}
+
+// send never blocks the caller, a page too slow to read its stream misses
+// the message and catches up with the next status
+func (subscription *Subscription) send(message string) {
+	select {
+	case subscription.messages <- message:
+	default:
+	}
+}
+
+// notifyRoute sends a frame to every page waiting on a route
+func notifyRoute(name string, message string) {
+	subscriptionsMutex.Lock()
+	defer subscriptionsMutex.Unlock()
+
+	for _, sessionSubscriptions := range subscriptions[name] {
+		for subscription := range sessionSubscriptions {
+			subscription.send(message)
+		}
+	}
+}
+
+// notifyPositions pushes the new absolute status to the waiters of a route
+// whose position changed
+func notifyPositions(name string) {
+	subscriptionsMutex.Lock()
+	defer subscriptionsMutex.Unlock()
+
+	for keyEnc, sessionSubscriptions := range subscriptions[name] {
+		status := queueStatus(name, keyEnc)
+		if status.Position == 0 && isQueued(name, keyEnc) {
+			// still in the pre-queue of the event
+			continue
+		}
+		for subscription := range sessionSubscriptions {
+			if subscription.position == status.Position {
+				continue
+			}
+			subscription.position = status.Position
+			subscription.send(sseFrame("", status.String()))
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const WAITING_TEMPLATE = "index.html"
+const FULL_TEMPLATE = "full.html"
+
+// the default pages and assets are built into the binary, files of
+// vwr_template_dir take precedence over them
+//
+//go:embed static/index.html static/full.html static/lineq static/locales
+var embeddedStatic embed.FS
+
+var service_vwr_template_dir string
+
+// PageData holds the variables available to the page templates
+type PageData struct {
+	Localizer
+	Route         string
+	Host          string
+	Path          string
+	Position      int
+	QueueSize     int
+	EstimatedWait int
+	EventStart    time.Time
+	RetryAfter    int
+	Challenge     string
+	Difficulty    int
+}
+
+type cachedTemplate struct {
+	template *template.Template
+	modTime  time.Time
+}
+
+var pageTemplates = make(map[string]cachedTemplate)
+var pageTemplatesMutex sync.Mutex
+
+func (route Route) waitingTemplate() string {
+	if route.TEMPLATE != "" {
+		return route.TEMPLATE
+	}
+	return WAITING_TEMPLATE
+}
+
+func (route Route) fullTemplate() string {
+	if route.FULL_PAGE != "" {
+		return route.FULL_PAGE
+	}
+	return FULL_TEMPLATE
+}
+
+// templatePath returns the file overriding a page for a route, a file in the
+// directory named after the route wins over one at the root of the
+// template directory. It returns false when the embedded page is used.
+func templatePath(name string, page string) (string, os.FileInfo, bool) {
+	if service_vwr_template_dir == "" {
+		return "", nil, false
+	}
+
+	for _, path := range []string{
+		filepath.Join(service_vwr_template_dir, name, page),
+		filepath.Join(service_vwr_template_dir, page),
+	} {
+		info, err := os.Stat(path)
+		if err == nil && !info.IsDir() {
+			return path, info, true
+		}
+	}
+	return "", nil, false
+}
+
+// loadTemplate returns the parsed page of a route. Files are parsed again
+// when they change on disk, a file that fails to parse keeps the last
+// version that did.
+func loadTemplate(name string, page string) (*template.Template, error) {
+	path, info, exists := templatePath(name, page)
+	if !exists {
+		path = "static/" + page
+	}
+
+	pageTemplatesMutex.Lock()
+	defer pageTemplatesMutex.Unlock()
+
+	cached, loaded := pageTemplates[path]
+	if loaded && (!exists || !info.ModTime().After(cached.modTime)) {
+		return cached.template, nil
+	}
+
+	var data []byte
+	var err error
+	var modTime time.Time
+	if exists {
+		data, err = os.ReadFile(path)
+		modTime = info.ModTime()
+	} else {
+		data, err = embeddedStatic.ReadFile(path)
+	}
+	if err == nil {
+		var parsed *template.Template
+		parsed, err = template.New(page).Parse(string(data))
+		if err == nil {
+			if loaded {
+				log.Printf("reloaded template %s\n", path)
+			}
+			pageTemplates[path] = cachedTemplate{template: parsed, modTime: modTime}
+			return parsed, nil
+		}
+	}
+
+	if loaded {
+		log.Printf("Error reloading template %s: %v\n", path, err)
+		cached.modTime = modTime
+		pageTemplates[path] = cached
+		return cached.template, nil
+	}
+	return nil, err
+}
+
+// renderPage executes a page template of a route and writes it with the
+// given status
+func renderPage(w http.ResponseWriter, name string, page string, data PageData, statusCode int) {
+	tmpl, err := loadTemplate(name, page)
+	if err != nil {
+		log.Printf("Error loading template %s of %s: %v\n", page, name, err)
+		http.Error(w, "Error loading page", http.StatusInternalServerError)
+		return
+	}
+
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		log.Printf("Error rendering template %s of %s: %v\n", page, name, err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Vary", "Accept-Language")
+	w.WriteHeader(statusCode)
+	w.Write(body.Bytes())
+}
+
+// requestRoute returns the route and the queue key of the visitor of a page
+// request, as forwarded by HAProxy
+func requestRoute(r *http.Request) (string, string) {
+	hostname := r.Host
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		hostname = host
+	}
+	name := queueName(hostname, r.URL.Path)
+
+	_, keyEnc := sessionKey(requestSid(r, name), name)
+	return name, keyEnc
+}
+
+// requestSid returns the session id of a page request, with signed sessions
+// only a valid session of the route counts
+func requestSid(r *http.Request, name string) string {
+	if signedSessions() {
+		sid, _ := signedSession(r, name)
+		return sid
+	}
+
+	sid := r.Header.Get(SESSION_HEADER)
+	if sid == "" {
+		sid = cookieValue(r.Header.Get("Cookie"), "sessionid")
+	}
+	return sid
+}
+
+func pageData(r *http.Request, name string, keyEnc string) PageData {
+	route := routes[name]
+	status := queueStatus(name, keyEnc)
+	return PageData{
+		Localizer:     requestLocalizer(r, name),
+		Route:         name,
+		Host:          route.HOST,
+		Path:          route.PATH,
+		Position:      status.Position,
+		QueueSize:     status.QueueSize,
+		EstimatedWait: status.EstimatedWait,
+		EventStart:    route.EVENT_START,
+		RetryAfter:    route.retryAfter(),
+		Challenge:     issueChallenge(name, keyEnc),
+		Difficulty:    route.POW_DIFFICULTY,
+	}
+}
+
+func serveWaitingPage(w http.ResponseWriter, r *http.Request) {
+	name, keyEnc := requestRoute(r)
+	renderPage(w, name, routes[name].waitingTemplate(), pageData(r, name, keyEnc), http.StatusOK)
+}
+
+// serveAsset serves the files under /lineq/ from the template directory or
+// from the embedded assets
+func serveAsset(w http.ResponseWriter, r *http.Request, asset string) {
+	asset = strings.TrimPrefix(filepath.Clean("/"+asset), "/")
+	if service_vwr_template_dir != "" {
+		path := filepath.Join(service_vwr_template_dir, "lineq", asset)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			http.ServeFile(w, r, path)
+			return
+		}
+	}
+
+	assets, _ := fs.Sub(embeddedStatic, "static/lineq")
+	request := r.Clone(r.Context())
+	request.URL.Path = "/" + asset
+	http.FileServer(http.FS(assets)).ServeHTTP(w, request)
+}
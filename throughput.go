@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+)
+
+const THROUGHPUT_WINDOW = 5 * time.Minute
+const STATUS_INTERVAL = 5 * time.Second
+
+type QueueStatus struct {
+	Position      int `json:"position"`
+	EstimatedWait int `json:"eta"`
+	QueueSize     int `json:"queue"`
+}
+
+var admissions = make(map[string][]time.Time)
+var admissionsMutex sync.Mutex
+
+// recordAdmission counts a visitor let into a route, either by lineq from the
+// queue or by HAProxy on a free slot
+func recordAdmission(name string) {
+	admissionsMutex.Lock()
+	defer admissionsMutex.Unlock()
+
+	now := time.Now()
+	admissions[name] = append(pruneAdmissions(admissions[name], now), now)
+	countAdmission(name)
+}
+
+func pruneAdmissions(times []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > THROUGHPUT_WINDOW {
+		i++
+	}
+	return times[i:]
+}
+
+// throughput returns the admissions per minute of a route over the last
+// window, before anybody was admitted it falls back to what the route
+// settings allow
+func throughput(name string) float64 {
+	admissionsMutex.Lock()
+	recent := pruneAdmissions(admissions[name], time.Now())
+	admissions[name] = recent
+	admissionsMutex.Unlock()
+
+	if len(recent) > 0 {
+		return float64(len(recent)) / THROUGHPUT_WINDOW.Minutes()
+	}
+
+	route := routes[name]
+	if route.admissionMode() == ADMISSION_RATE {
+		return float64(route.ADMISSION_RATE)
+	}
+	if route.sessionDuration() > 0 {
+		return float64(route.TOTAL_ACTIVE_USERS) / float64(route.sessionDuration())
+	}
+	return 0
+}
+
+// estimatedWait returns the seconds a visitor at the given position is
+// expected to wait, -1 when it cannot be estimated
+func estimatedWait(name string, position int) int {
+	if position <= 0 {
+		return 0
+	}
+
+	perMinute := throughput(name)
+	if perMinute <= 0 {
+		return -1
+	}
+	return int(math.Ceil(float64(position) / perMinute * 60))
+}
+
+func queueStatus(name string, keyEnc string) QueueStatus {
+	position := queuePosition(name, keyEnc)
+	return QueueStatus{
+		Position:      position,
+		EstimatedWait: estimatedWait(name, position),
+		QueueSize:     queueLength(name),
+	}
+}
+
+func (status QueueStatus) String() string {
+	data, _ := json.Marshal(status)
+	return string(data)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const TOKEN_COOKIE = "lineq_token"
+
+// AccessToken lets a visitor skip the queue of a route (Bypass) or wait in
+// one of its priority lanes (Lane). An empty Route matches every route.
+type AccessToken struct {
+	Route  string `json:"route"`
+	Lane   string `json:"lane,omitempty"`
+	Bypass bool   `json:"bypass,omitempty"`
+	Expiry int64  `json:"exp"`
+}
+
+var service_vwr_token_secret string
+
+// bypassSessions maps the sessions admitted past the queue to their route
+var bypassSessions = make(map[string]string)
+
+func tokenSignature(payload string) string {
+	mac := hmac.New(sha256.New, []byte(service_vwr_token_secret))
+	mac.Write([]byte(payload))
+	return b64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signToken encodes a token as base64url(json).base64url(hmac-sha256)
+func signToken(token AccessToken) string {
+	data, _ := json.Marshal(token)
+	payload := b64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + tokenSignature(payload)
+}
+
+func verifyToken(value string, name string) (AccessToken, error) {
+	var token AccessToken
+	if service_vwr_token_secret == "" {
+		return token, errors.New("access tokens are disabled")
+	}
+
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return token, errors.New("malformed token")
+	}
+
+	if !hmac.Equal([]byte(parts[1]), []byte(tokenSignature(parts[0]))) {
+		return token, errors.New("invalid signature")
+	}
+
+	data, err := b64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return token, errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return token, errors.New("malformed token")
+	}
+
+	if time.Now().Unix() >= token.Expiry {
+		return token, errors.New("expired token")
+	}
+	if token.Route != "" && token.Route != name {
+		return token, errors.New("token for another route")
+	}
+	return token, nil
+}
+
+// applyAccessToken grants a slot or moves the session to a priority lane
+// according to the token presented by the visitor
+func applyAccessToken(value string, name string, id string, keyEnc string) {
+	token, err := verifyToken(value, name)
+	if err != nil {
+		log.Printf("rejected token for %s: %v\n", id, err)
+		return
+	}
+
+	if token.Bypass {
+		grantSlot(name, id, keyEnc)
+	} else if token.Lane != "" {
+		if !routes[name].hasLane(token.Lane) {
+			log.Printf("rejected token for %s: no lane %s on %s\n", id, token.Lane, name)
+			return
+		}
+		moveToLane(name, keyEnc, token.Lane)
+	}
+	// the sessions behind it moved up
+	notifyPositions(name)
+}
+
+// grantSlot admits a session right away by setting its gpc1, bypass sessions
+// do not take a slot from the room
+func grantSlot(name string, id string, keyEnc string) {
+	userTable, exists := tables[service_vwr_user_table]
+	if !exists {
+		log.Printf("cannot grant a slot to %s, no user table yet\n", id)
+		return
+	}
+
+	removeFromQueue(name, keyEnc)
+
+	entry, exists := userTable.entries[keyEnc]
+	if !exists {
+		entry = Entry{
+			Key: id,
+		}
+		entry.Values = make(map[int][]int)
+		entry.Values[GPC1] = []int{0}
+	}
+	entry.Values[GPC1][0] = 1
+	userTable.entries[keyEnc] = entry
+	bypassSessions[keyEnc] = name
+
+	updateClients(userTable.definition, keyEnc, id)
+	touchSession(keyEnc, name)
+	sendTableUpdate(service_vwr_user_table, keyEnc)
+}
+
+func generateAccessToken(route string, lane string, ttl int) {
+	if service_vwr_token_secret == "" {
+		fmt.Println("vwr_token_secret is not configured")
+		return
+	}
+
+	if route == "*" {
+		route = ""
+	}
+	token := AccessToken{
+		Route:  route,
+		Lane:   lane,
+		Bypass: lane == "",
+		Expiry: time.Now().Add(time.Duration(ttl) * time.Minute).Unix(),
+	}
+	fmt.Println(signToken(token))
+}
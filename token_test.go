@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLaneTokens(t *testing.T) {
+	withRoomState(t, map[string]Route{"shop": {HOST: "shop.example.com", PATH: "/", TOTAL_ACTIVE_USERS: 1, LANES: map[string]int{"vip": 3}}})
+	previous := service_vwr_token_secret
+	service_vwr_token_secret = "secret"
+	t.Cleanup(func() {
+		service_vwr_token_secret = previous
+	})
+
+	first := queueSession("shop", "first")
+	vip := queueSession("shop", "vip")
+	unknown := queueSession("shop", "unknown")
+
+	expiry := time.Now().Add(time.Minute).Unix()
+	id, _ := sessionKey("vip", "shop")
+	applyAccessToken(signToken(AccessToken{Route: "shop", Lane: "vip", Expiry: expiry}), "shop", id, vip)
+	id, _ = sessionKey("unknown", "shop")
+	applyAccessToken(signToken(AccessToken{Route: "shop", Lane: "staff", Expiry: expiry}), "shop", id, unknown)
+
+	if laneQueue("shop", "vip").Position(vip) != 1 {
+		t.Errorf("the vip token did not move the session to the vip lane")
+	}
+	if _, exists := priorityLanes["shop"]["staff"]; exists {
+		t.Errorf("a token created the lane staff the route does not have")
+	}
+	if position := queuePosition("shop", unknown); position != 3 {
+		t.Errorf("the session of the unknown lane token is at %d, want 3", position)
+	}
+	if position := queuePosition("shop", first); position != 2 {
+		t.Errorf("the first session is at %d behind one vip, want 2", position)
+	}
+}
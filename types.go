@@ -6,6 +6,7 @@ type EntryUpdate struct {
 	KeyType  int
 	KeyValue interface{}
 	Values map[int][]int
+	Origin   Origin
 }
 
 type Entry struct {
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// user table keys are USER_KEY_VERSION:route:session, route names never
+// contain ':' and the session id is everything after the second ':'. Session
+// ids are the uuids of HAProxy or the signed session tokens of lineq.
+const USER_KEY_VERSION = "lq1"
+const MAX_ROUTE_NAME_LEN = 32
+const MAX_SESSION_ID_LEN = 80
+const USER_KEY_LEN = len(USER_KEY_VERSION) + MAX_ROUTE_NAME_LEN + MAX_SESSION_ID_LEN + 2
+
+type UserKey struct {
+	Route   string
+	Session string
+}
+
+type KeyStats struct {
+	Version       string    `json:"version"`
+	Parsed        int       `json:"parsed"`
+	Malformed     int       `json:"malformed"`
+	LastMalformed string    `json:"last_malformed,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastRejected  time.Time `json:"last_rejected"`
+}
+
+var keyStats = KeyStats{Version: USER_KEY_VERSION}
+var keyStatsMutex sync.Mutex
+
+func (key UserKey) String() string {
+	return USER_KEY_VERSION + ":" + key.Route + ":" + key.Session
+}
+
+func parseUserKey(raw string) (UserKey, error) {
+	parts := strings.SplitN(raw, ":", 3)
+	if len(parts) != 3 {
+		return UserKey{}, errors.New("not a versioned key")
+	}
+	if parts[0] != USER_KEY_VERSION {
+		return UserKey{}, errors.New("unsupported key version " + parts[0])
+	}
+
+	key := UserKey{Route: parts[1], Session: parts[2]}
+	if !routeNamePattern.MatchString(key.Route) {
+		return UserKey{}, errors.New("invalid route name")
+	}
+	if key.Session == "" || len(key.Session) > MAX_SESSION_ID_LEN {
+		return UserKey{}, errors.New("invalid session id")
+	}
+	return key, nil
+}
+
+// readUserKey parses a key HAProxy stored in the user table, malformed keys
+// are counted and logged instead of reaching the queue
+func readUserKey(raw string) (UserKey, bool) {
+	key, err := parseUserKey(raw)
+	if err == nil {
+		if _, exists := routes[key.Route]; !exists {
+			err = errors.New("unknown route " + key.Route)
+		} else if signedSessions() {
+			// HAProxy tracks whatever session cookie it is sent
+			_, err = verifySession(key.Session, key.Route)
+		}
+	}
+
+	keyStatsMutex.Lock()
+	defer keyStatsMutex.Unlock()
+
+	if err != nil {
+		log.Printf("rejected user table key %q: %v\n", raw, err)
+		keyStats.Malformed++
+		keyStats.LastMalformed = raw
+		keyStats.LastError = err.Error()
+		keyStats.LastRejected = time.Now()
+		return UserKey{}, false
+	}
+	keyStats.Parsed++
+	return key, true
+}
+
+// getKeyStats serves GET /api/v1/keys, the counts of user table keys lineq
+// parsed and rejected
+func getKeyStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keyStatsMutex.Lock()
+	stats := keyStats
+	keyStatsMutex.Unlock()
+
+	writeJSON(w, http.StatusOK, stats)
+}
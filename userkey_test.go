@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func withKeyStats(t *testing.T) {
+	previous := keyStats
+	keyStats = KeyStats{Version: USER_KEY_VERSION}
+	t.Cleanup(func() {
+		keyStats = previous
+	})
+}
+
+func TestParseUserKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		raw   string
+		want  UserKey
+		valid bool
+	}{
+		{"versioned key", "lq1:shop:3f2a9c", UserKey{Route: "shop", Session: "3f2a9c"}, true},
+		{"colon in session", "lq1:shop:a:b", UserKey{Route: "shop", Session: "a:b"}, true},
+		{"legacy key", "3f2a9c-0b1e", UserKey{}, false},
+		{"legacy route key", "shop3f2a9c", UserKey{}, false},
+		{"wrong version", "lq2:shop:3f2a9c", UserKey{}, false},
+		{"too few fields", "lq1:shop", UserKey{}, false},
+		{"empty session", "lq1:shop:", UserKey{}, false},
+		{"empty route", "lq1::3f2a9c", UserKey{}, false},
+		{"dot route", "lq1:..:3f2a9c", UserKey{}, false},
+		{"oversized session", "lq1:shop:" + strings.Repeat("a", MAX_SESSION_ID_LEN+1), UserKey{}, false},
+		{"longest session", "lq1:shop:" + strings.Repeat("a", MAX_SESSION_ID_LEN), UserKey{Route: "shop", Session: strings.Repeat("a", MAX_SESSION_ID_LEN)}, true},
+		{"oversized route", "lq1:" + strings.Repeat("r", MAX_ROUTE_NAME_LEN+1) + ":3f2a9c", UserKey{}, false},
+	}
+	for _, test := range tests {
+		key, err := parseUserKey(test.raw)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: parseUserKey(%q) error %v, want valid %v", test.name, test.raw, err, test.valid)
+			continue
+		}
+		if key != test.want {
+			t.Errorf("%s: parseUserKey(%q) = %+v, want %+v", test.name, test.raw, key, test.want)
+		}
+		if test.valid && len(key.String()) > USER_KEY_LEN {
+			t.Errorf("%s: %q does not fit in len %d", test.name, key.String(), USER_KEY_LEN)
+		}
+	}
+}
+
+func TestReadUserKeyCounts(t *testing.T) {
+	withRoomState(t, map[string]Route{"shop": {HOST: "shop.example.com", PATH: "/"}})
+	withKeyStats(t)
+
+	rejected := []string{
+		"3f2a9c-0b1e",
+		"lq2:shop:3f2a9c",
+		"lq1:shop",
+		"lq1:blog:3f2a9c",
+		"lq1:shop:" + strings.Repeat("a", MAX_SESSION_ID_LEN+1),
+	}
+	for i, raw := range rejected {
+		if _, valid := readUserKey(raw); valid {
+			t.Errorf("readUserKey(%q) accepted", raw)
+		}
+		if keyStats.Malformed != i+1 || keyStats.LastMalformed != raw {
+			t.Errorf("after %q: %d malformed, last %q", raw, keyStats.Malformed, keyStats.LastMalformed)
+		}
+	}
+
+	if key, valid := readUserKey("lq1:shop:3f2a9c"); !valid || key.Session != "3f2a9c" {
+		t.Errorf("valid key rejected")
+	}
+	if keyStats.Parsed != 1 || keyStats.Malformed != len(rejected) {
+		t.Errorf("%d parsed and %d malformed, want 1 and %d", keyStats.Parsed, keyStats.Malformed, len(rejected))
+	}
+}
+
+func TestReadUserKeySigned(t *testing.T) {
+	withRoomState(t, map[string]Route{"shop": {HOST: "shop.example.com", PATH: "/"}, "blog": {HOST: "blog.example.com", PATH: "/"}})
+	withKeyStats(t)
+	withSessionKeys(t, []SessionKey{{ID: "k", SECRET: "secret"}}, 60)
+
+	token := signSession(newSessionId(), "shop", time.Now())
+	tampered := token[:len(token)-1] + "A"
+	if strings.HasSuffix(token, "A") {
+		tampered = token[:len(token)-1] + "B"
+	}
+	if _, valid := readUserKey(UserKey{Route: "shop", Session: token}.String()); !valid {
+		t.Errorf("signed session rejected: %s", keyStats.LastError)
+	}
+
+	forged := []string{
+		UserKey{Route: "shop", Session: "3f2a9c"}.String(),
+		UserKey{Route: "blog", Session: token}.String(),
+		UserKey{Route: "shop", Session: tampered}.String(),
+	}
+	for i, raw := range forged {
+		if _, valid := readUserKey(raw); valid {
+			t.Errorf("readUserKey(%q) accepted", raw)
+		}
+		if keyStats.Malformed != i+1 {
+			t.Errorf("after %q: %d malformed, want %d", raw, keyStats.Malformed, i+1)
+		}
+	}
+}
+
+func TestRejectedKeyNotStored(t *testing.T) {
+	withRoomState(t, map[string]Route{"shop": {HOST: "shop.example.com", PATH: "/", TOTAL_ACTIVE_USERS: 1}})
+	withKeyStats(t)
+
+	client := &Client{
+		mode:                "vwr",
+		roomTable:           service_vwr_room_table,
+		tables:              map[string]Table{service_vwr_user_table: {entries: make(map[string]Entry)}},
+		group:               newGroup(DEFAULT_GROUP, "", PeerGroup{}, tables),
+		lastTableDefinition: tables[service_vwr_user_table].definition,
+	}
+
+	keyEnc, accepted := client.updateTable(EntryUpdate{KeyType: STRING, KeyValue: "lq2:shop:3f2a9c", Values: map[int][]int{GPC1: {0}}})
+	if accepted {
+		t.Errorf("malformed key accepted")
+	}
+	if _, exists := tables[service_vwr_user_table].entries[keyEnc]; exists || queueLength("shop") != 0 {
+		t.Errorf("malformed key reached the room")
+	}
+
+	keyEnc, accepted = client.updateTable(EntryUpdate{KeyType: STRING, KeyValue: "lq1:shop:3f2a9c", Values: map[int][]int{GPC1: {0}}})
+	if !accepted || queuePosition("shop", keyEnc) != 1 {
+		t.Errorf("valid key not queued")
+	}
+}
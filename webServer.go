@@ -1,19 +1,21 @@
 package main
 
 import (
+	"bytes"
 	b64 "encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-var users = make(map[chan string]bool)
-
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -25,37 +27,167 @@ type ResponseBody struct {
 }
 
 type ConfigResponse struct {
-	Status               string `json:"status"`
-	Message              string `json:"message"`
-	RoomTableName        string `json:"lineq_room_table"`
-	UserTableName        string `json:"lineq_user_table"`
-	LineqSessionDuration int    `json:"lineq_session_duration"`
+	Status               string           `json:"status"`
+	Message              string           `json:"message"`
+	RoomTableName        string           `json:"lineq_room_table"`
+	UserTableName        string           `json:"lineq_user_table"`
+	LineqSessionDuration int              `json:"lineq_session_duration"`
+	Routes               map[string]Route `json:"lineq_routes"`
 }
 
 type RequestBody struct {
-	Name        string `json:"name"`
-	Path        string `json:"path"`
-	Host        string `json:"host"`
-	ActiveUsers int    `json:"activeUsers"`
+	Name            string    `json:"name"`
+	Path            string    `json:"path"`
+	Host            string    `json:"host"`
+	ActiveUsers     int       `json:"activeUsers"`
+	SessionDuration int       `json:"sessionDuration"`
+	MaxQueueLength  int       `json:"maxQueueLength"`
+	AdmissionMode   string    `json:"admissionMode"`
+	AdmissionRate   int       `json:"admissionRate"`
+	EventStart      time.Time `json:"eventStart"`
+	EventEnd        time.Time `json:"eventEnd"`
+}
+
+type RouteRequestBody struct {
+	Name   string `json:"name"`
+	Closed bool   `json:"closed"`
 }
 
+// MAX_REQUEST_BODY bounds the bodies read before the room is locked
+const MAX_REQUEST_BODY = 1 << 20
+
+// WEB_CLIENT_QUEUE_LEN is the number of messages that may wait for a
+// dashboard, a dashboard falling further behind is disconnected
+const WEB_CLIENT_QUEUE_LEN = 256
+
 type WebClient struct {
 	conn *websocket.Conn
+	out  chan []byte
 }
 
+// webClients is guarded by roomMutex
 var webClients []*WebClient
 
+// send queues a message for the dashboard, it never blocks so that the room
+// can stay locked while the dashboards are updated
+func (webClient *WebClient) send(message []byte) {
+	select {
+	case webClient.out <- message:
+	default:
+		log.Println("dashboard does not keep up, disconnecting it")
+		removeWebClient(webClient)
+		webClient.conn.Close()
+	}
+}
+
+func (webClient *WebClient) writeMessages() {
+	for message := range webClient.out {
+		if err := webClient.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			log.Println("WebSocket write error:", err)
+			webClient.conn.Close()
+			withRoom(func() {
+				removeWebClient(webClient)
+			})
+			return
+		}
+	}
+}
+
+// removeWebClient stops the updates of a dashboard, the room has to be locked
+func removeWebClient(webClient *WebClient) {
+	for i, client := range webClients {
+		if client == webClient {
+			webClients = append(webClients[:i], webClients[i+1:]...)
+			close(webClient.out)
+			return
+		}
+	}
+}
+
+func sendWebClients(message []byte) {
+	for _, webClient := range append([]*WebClient{}, webClients...) {
+		webClient.send(message)
+	}
+}
+
 func initWebServer(web_host string, web_port string) {
 	http.HandleFunc("/", handleWebRequests)
-	http.HandleFunc("/tables", getTables)
-	http.HandleFunc("/getConfig", getConfig)
-	http.HandleFunc("/create", createTables)
+	http.HandleFunc("/tables", lockRoom(getTables))
+	http.HandleFunc("/lineq/challenge", lockRoom(handleChallenge))
+	http.HandleFunc("/getConfig", lockRoom(getConfig))
+	http.HandleFunc("/create", lockRoom(createTables))
+	http.HandleFunc("/close", lockRoom(closeTables))
+	http.HandleFunc("/pause", lockRoom(routeAction(pauseRoute)))
+	http.HandleFunc("/resume", lockRoom(routeAction(resumeRoute)))
+	http.HandleFunc("/drain", lockRoom(routeAction(drainRoute)))
+	http.HandleFunc("/api/v1/routes", lockRoom(handleRoutes))
+	http.HandleFunc("/api/v1/routes/", lockRoom(handleRoutes))
+	http.HandleFunc("/api/v1/abandonment", lockRoom(getAbandonment))
+	http.HandleFunc("/api/v1/offenders", lockRoom(getOffenders))
+	http.HandleFunc("/api/v1/keys", getKeyStats)
+	http.HandleFunc("/api/v1/metrics", lockRoom(getMetrics))
+	http.HandleFunc("/api/v1/webhooks/ping", pingWebhooks)
+	http.HandleFunc("/api/v1/autoscale", getAutoscale)
+	http.HandleFunc(QUEUE_API, handleQueueStatus)
+	http.HandleFunc(QUEUE_API+"/", handleQueueStatus)
 	http.HandleFunc("/ws", handleWebSocket)
 	addr := web_host + ":" + web_port
 	log.Println("Server is running on ", addr)
 	http.ListenAndServe(addr, nil)
 }
 
+// lockRoom runs a handler with the waiting room locked, handlers that stream
+// or wait lock it themselves around each read. The request body is read
+// before and the response is sent after the room is locked, so that a slow
+// client never holds the room.
+func lockRoom(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_REQUEST_BODY))
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		response := &roomResponse{header: make(http.Header)}
+		withRoom(func() {
+			handler(response, r)
+		})
+		response.send(w)
+	}
+}
+
+// roomResponse holds a response written with the room locked
+type roomResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (response *roomResponse) Header() http.Header {
+	return response.header
+}
+
+func (response *roomResponse) WriteHeader(statusCode int) {
+	if response.status == 0 {
+		response.status = statusCode
+	}
+}
+
+func (response *roomResponse) Write(data []byte) (int, error) {
+	response.WriteHeader(http.StatusOK)
+	return response.body.Write(data)
+}
+
+func (response *roomResponse) send(w http.ResponseWriter) {
+	for key, values := range response.header {
+		w.Header()[key] = values
+	}
+	response.WriteHeader(http.StatusOK)
+	w.WriteHeader(response.status)
+	w.Write(response.body.Bytes())
+}
+
 func handleWebRequests(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get("Accept") == "text/event-stream" {
 		cookie := r.URL.Query().Get("info")
@@ -63,70 +195,164 @@ func handleWebRequests(w http.ResponseWriter, r *http.Request) {
 		pathname := r.URL.Query().Get("path")
 		log.Println(cookie, hostname, pathname)
 		handleSSE(w, r, cookie, hostname, pathname)
-	} else if strings.Contains(r.URL.Path, "/lineq/") {
+		return
+	}
+
+	if strings.Contains(r.URL.Path, "/lineq/") {
 		parts := strings.SplitN(r.URL.Path, "/lineq/", 2)
-		if len(parts) > 1 {
-			newPath := "/static/lineq/" + parts[1]
-			http.ServeFile(w, r, "."+newPath)
-			return
-		}
-		http.ServeFile(w, r, "./static/index.html")
-	} else {
-		http.ServeFile(w, r, "./static/index.html")
+		serveAsset(w, r, parts[1])
+		return
 	}
+	lockRoom(servePage)(w, r)
+}
+
+// servePage answers a visitor HAProxy sent to lineq
+func servePage(w http.ResponseWriter, r *http.Request) {
+	issueSessionCookie(w, r)
+	if serveAccessRules(w, r) || serveOverflowPage(w, r) || serveLimitPage(w, r) {
+		return
+	}
+	serveWaitingPage(w, r)
 }
 
 func handleSSE(w http.ResponseWriter, r *http.Request, cookie string, hostname string, pathname string) {
+	var name string
+	withRoom(func() {
+		name = queueName(hostname, pathname)
+	})
+	if name == "" {
+		http.Error(w, "Unknown route", http.StatusNotFound)
+		return
+	}
+	sid, err := sessionId(r, cookie, name)
+	if err != nil {
+		log.Println("rejected session:", err)
+		http.Error(w, "Invalid session", http.StatusForbidden)
+		return
+	}
+	id, keyEnc := sessionKey(sid, name)
+
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
-	messageChan := make(chan string)
+	subscription := subscribe(name, keyEnc)
+	defer withRoom(func() {
+		unsubscribe(subscription)
+	})
+	done := r.Context().Done()
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = cookieValue(cookie, TOKEN_COOKIE)
+	}
 
-	users[messageChan] = true
+	// frames that end the stream right away
+	last := ""
+	var countdown int
+	var pending bool
+	withRoom(func() {
+		if token != "" {
+			applyAccessToken(token, name, id, keyEnc)
+		}
+		if routeClosed(name) {
+			last = sseFrame("closed", "")
+		} else if queueFull(name) && !isQueued(name, keyEnc) {
+			last = sseFrame("full", strconv.Itoa(routes[name].retryAfter()))
+		}
+		countdown, pending = eventCountdown(name)
+	})
+	if last != "" {
+		fmt.Fprint(w, last)
+		w.(http.Flusher).Flush()
+		return
+	}
 
-	notify := w.(http.CloseNotifier).CloseNotify()
-	go func() {
-		<-notify
-		delete(users, messageChan)
-		close(messageChan)
-	}()
+	if pending {
+		if !waitForEvent(w, done, subscription, name, countdown) {
+			return
+		}
+	}
 
-	initialQueue := getQueue(cookie, hostname, pathname)
-	fmt.Fprintf(w, "data: %s\n\n", initialQueue)
+	fmt.Fprint(w, sseFrame("", getQueue(id, name, keyEnc)))
 	w.(http.Flusher).Flush()
 
-	for message := range messageChan {
-		fmt.Fprintf(w, "data: %s\n\n", message)
+	ticker := time.NewTicker(STATUS_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case message := <-subscription.messages:
+			fmt.Fprint(w, message)
+		case <-ticker.C:
+			fmt.Fprint(w, sseFrame("", getQueue(id, name, keyEnc)))
+		}
 		w.(http.Flusher).Flush()
 	}
 }
 
-func getQueue(cookie string, hostname string, pathname string) string {
+// waitForEvent streams the countdown of a route event until it starts, it
+// returns false if the visitor left before
+func waitForEvent(w http.ResponseWriter, done <-chan struct{}, subscription *Subscription, name string, countdown int) bool {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
-	domain := strings.Replace(hostname, ".", "_", -1)
-	path := strings.Replace(pathname, "/", "_", -1)
-	name := fmt.Sprintf("%s%s", domain, path)
+	pending := true
+	for pending {
+		fmt.Fprint(w, sseFrame("countdown", strconv.Itoa(countdown)))
+		w.(http.Flusher).Flush()
 
-	sid := strings.Split(cookie, "=")[1]
-	id := fmt.Sprintf("%s@%s", sid, name)
-	log.Println(name, id)
-	key := []byte(id)
-	jsonKey, _ := json.Marshal(&key)
-	keyEnc := b64.StdEncoding.EncodeToString(jsonKey)
-	j := -1
-	for i := 0; i < len(sortedEntries[name]); i++ {
-		if sortedEntries[name][i] == keyEnc {
-			j = i
-			break
+		select {
+		case <-done:
+			return false
+		case message := <-subscription.messages:
+			// positions do not move before the event starts
+			if strings.HasPrefix(message, "event:") {
+				fmt.Fprint(w, message)
+			}
+		case <-ticker.C:
+			withRoom(func() {
+				countdown, pending = eventCountdown(name)
+			})
 		}
 	}
-	return fmt.Sprintf("%d", j+1)
+	return true
 }
 
-func broadcast() {
-	for user := range users {
-		user <- "DEC"
+// queueName returns the route a page of hostname and pathname belongs to, or
+// "" when no route matches
+func queueName(hostname string, pathname string) string {
+	name, _ := matchRoute(hostname, pathname)
+	return name
+}
+
+func cookieValue(cookies string, name string) string {
+	request := http.Request{Header: http.Header{"Cookie": {cookies}}}
+	cookie, err := request.Cookie(name)
+	if err != nil {
+		return ""
 	}
+	return cookie.Value
+}
+
+func sessionKey(sid string, name string) (string, string) {
+	id := UserKey{Route: name, Session: sid}.String()
+	key := []byte(id)
+	jsonKey, _ := json.Marshal(&key)
+	keyEnc := b64.StdEncoding.EncodeToString(jsonKey)
+	return id, keyEnc
+}
+
+// getQueue is the status frame of the stream of a session, the stream does
+// not hold the room while it waits so it locks it for each frame
+func getQueue(id string, name string, keyEnc string) string {
+	log.Println(name, id)
+
+	roomMutex.Lock()
+	defer roomMutex.Unlock()
+
+	return queueStatus(name, keyEnc).String()
 }
 
 func getTables(w http.ResponseWriter, r *http.Request) {
@@ -146,6 +372,7 @@ func getConfig(w http.ResponseWriter, r *http.Request) {
 		RoomTableName:        service_vwr_room_table,
 		UserTableName:        service_vwr_user_table,
 		LineqSessionDuration: service_vwr_session_duration,
+		Routes:               routes,
 	}
 
 	jsonResponse, err := json.Marshal(response)
@@ -172,11 +399,23 @@ func createTables(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the settings /create does not know about (lanes, rules, autoscaling,
+	// templates...) are kept from the current route
 	name := requestBody.Name
-	path := requestBody.Path
-	host := requestBody.Host
-	activeUsers := requestBody.ActiveUsers
-	updateRoomTable(name, path, host, activeUsers)
+	route := routes[name].copy()
+	route.TOTAL_ACTIVE_USERS = requestBody.ActiveUsers
+	route.SESSION_DURATION = requestBody.SessionDuration
+	route.MAX_QUEUE_LENGTH = requestBody.MaxQueueLength
+	route.ADMISSION_MODE = requestBody.AdmissionMode
+	route.ADMISSION_RATE = requestBody.AdmissionRate
+	route.EVENT_START = requestBody.EventStart
+	route.EVENT_END = requestBody.EventEnd
+	route.PATH = requestBody.Path
+	route.HOST = requestBody.Host
+	if err := saveRoute(name, route); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	response := ResponseBody{
 		Status:  "success",
@@ -191,6 +430,70 @@ func createTables(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func closeTables(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var requestBody RouteRequestBody
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Error decoding JSON request body", http.StatusBadRequest)
+		return
+	}
+
+	if !closeRoute(requestBody.Name, requestBody.Closed) {
+		http.Error(w, "Unknown route", http.StatusNotFound)
+		return
+	}
+
+	response := ResponseBody{
+		Status:  "success",
+		Message: fmt.Sprintf("Route Updated"),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		http.Error(w, "Error encoding JSON response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func routeAction(action func(name string) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var requestBody RouteRequestBody
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, "Error decoding JSON request body", http.StatusBadRequest)
+			return
+		}
+
+		if !action(requestBody.Name) {
+			http.Error(w, "Unknown route", http.StatusNotFound)
+			return
+		}
+
+		response := ResponseBody{
+			Status:  "success",
+			Message: fmt.Sprintf("Route %s is %s", requestBody.Name, routes[requestBody.Name].state()),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(response)
+		if err != nil {
+			http.Error(w, "Error encoding JSON response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -201,18 +504,17 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	webClient := &WebClient{
 		conn: conn,
+		out:  make(chan []byte, WEB_CLIENT_QUEUE_LEN),
 	}
-	webClients = append(webClients, webClient)
+	go webClient.writeMessages()
 
-	log.Println("Client connected")
+	withRoom(func() {
+		webClients = append(webClients, webClient)
+		webClient.send(parseTables())
+		webClient.send(parseRoutes())
+	})
 
-	messageJSON := parseTables()
-
-	err = webClient.conn.WriteMessage(websocket.TextMessage, messageJSON)
-	if err != nil {
-		log.Println("WebSocket write error:", err)
-		return
-	}
+	log.Println("Client connected")
 }
 
 func parseEntry(id string, entry Entry, keyType string, dataType []int) map[string]interface{} {
@@ -247,7 +549,7 @@ func parseEntry(id string, entry Entry, keyType string, dataType []int) map[stri
 			dataValues += fmt.Sprintf("%d\t", entry.Values[dataType[i]][0])
 		case GPT0, GPC0, CONN_CNT, CONN_CUR, SESS_CNT, HTTP_REQ_CNT, HTTP_ERR_CNT, GPC1:
 			dataValues += fmt.Sprintf("%d\t", entry.Values[dataType[i]][0])
-		case HTTP_REQ_RATE:
+		case HTTP_REQ_RATE, HTTP_ERR_RATE:
 			dataValues += fmt.Sprintf("%d\t", entry.Values[dataType[i]][1])
 		case BYTES_IN_CNT, BYTES_OUT_CNT:
 		}
@@ -309,6 +611,8 @@ func getValueTypes(vTypes []int) string {
 			values += "gpc1  "
 		case HTTP_REQ_RATE:
 			values += "http_req_rate  "
+		case HTTP_ERR_RATE:
+			values += "http_err_rate  "
 		case BYTES_IN_CNT:
 			values += "bytes_in_cnt  "
 		case BYTES_OUT_CNT:
@@ -339,6 +643,14 @@ func parseTables() []byte {
 	for key, value := range tables {
 		jsonData[key] = parseTable(value)
 	}
+	for _, group := range groups {
+		if group.namespace == "" {
+			continue
+		}
+		for key, value := range group.tables {
+			jsonData[group.tableLabel(key)] = parseTable(value)
+		}
+	}
 
 	messageJSON, err := json.Marshal(jsonData)
 	if err != nil {
@@ -349,6 +661,10 @@ func parseTables() []byte {
 }
 
 func sendTableUpdate(tableName string, id string) {
+	sendGroupTableUpdate(groups[DEFAULT_GROUP], tableName, id)
+}
+
+func sendGroupTableUpdate(group *Group, tableName string, id string) {
 	if len(webClients) == 0 {
 		return
 	}
@@ -356,24 +672,54 @@ func sendTableUpdate(tableName string, id string) {
 	jsonData := make(map[string]interface{})
 	jsonData["mode"] = "update"
 
-	table := tables[tableName]
+	table := group.tables[tableName]
+	entry, exists := table.entries[id]
+	if !exists {
+		// the key was rejected or the entry is gone
+		return
+	}
 	tableDef := table.definition
-	entries := table.entries
 	dataType := tableDef.DataTypes
 	keyType := getKeyType(tableDef.KeyType)
 
 	tableInfo := make(map[string]interface{})
 	tableInfo["expiry"] = tableDef.Expiry
 	tableInfo["type"] = tableDef.KeyType
-	tableInfo["entry"] = parseEntry(id, entries[id], keyType, dataType)
-	jsonData[tableName] = tableInfo
+	tableInfo["entry"] = parseEntry(id, entry, keyType, dataType)
+	jsonData[group.tableLabel(tableName)] = tableInfo
 
 	messageJSON, _ := json.Marshal(jsonData)
+	sendWebClients(messageJSON)
+}
 
-	for i := 0; i < len(webClients); i++ {
-		err := webClients[i].conn.WriteMessage(websocket.TextMessage, messageJSON)
-		if err != nil {
-			log.Println("WebSocket write error:", err)
-		}
+func parseRoutes() []byte {
+	jsonRoutes := make(map[string]interface{})
+	for name, route := range routes {
+		jsonRoute := make(map[string]interface{})
+		jsonRoute["state"] = route.state()
+		jsonRoute["closed"] = route.CLOSED
+		jsonRoute["queue"] = queueLength(name)
+		jsonRoute["capacity"] = route.TOTAL_ACTIVE_USERS
+		jsonRoute["abandoned"] = abandonmentStats(name).Rate
+		jsonRoutes[name] = jsonRoute
+	}
+
+	jsonData := make(map[string]interface{})
+	jsonData["mode"] = "routes"
+	jsonData["routes"] = jsonRoutes
+
+	messageJSON, err := json.Marshal(jsonData)
+	if err != nil {
+		log.Println("JSON serialization error:", err)
+		return nil
+	}
+	return messageJSON
+}
+
+func sendRouteUpdate() {
+	if len(webClients) == 0 {
+		return
 	}
+
+	sendWebClients(parseRoutes())
 }
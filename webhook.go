@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const WEBHOOK_TICK = time.Second
+const WEBHOOK_TIMEOUT = 5 * time.Second
+const WEBHOOK_ATTEMPTS = 5
+
+const (
+	EVENT_QUEUE_STARTED     = "queue.started"
+	EVENT_QUEUE_CLEARED     = "queue.cleared"
+	EVENT_QUEUE_ABOVE       = "queue.threshold_above"
+	EVENT_QUEUE_BELOW       = "queue.threshold_below"
+	EVENT_ROUTE_PAUSED      = "route.paused"
+	EVENT_ROUTE_RESUMED     = "route.resumed"
+	EVENT_ROUTE_DRAINING    = "route.draining"
+	EVENT_ROUTE_DISABLED    = "route.disabled"
+	EVENT_CAPACITY_CHANGED  = "capacity.changed"
+	EVENT_WEBHOOK_PING      = "webhook.ping"
+	WEBHOOK_SIGNATURE       = "X-Lineq-Signature"
+	WEBHOOK_EVENT_HEADER    = "X-Lineq-Event"
+	WEBHOOK_DELIVERY_HEADER = "X-Lineq-Delivery"
+	WEBHOOK_TIME_HEADER     = "X-Lineq-Timestamp"
+)
+
+// Webhook is an endpoint notified of the events of the routes, empty EVENTS
+// or ROUTES subscribe to all of them
+type Webhook struct {
+	URL    string   `json:"url"`
+	SECRET string   `json:"secret"`
+	EVENTS []string `json:"events"`
+	ROUTES []string `json:"routes"`
+}
+
+type WebhookEvent struct {
+	ID    string                 `json:"id"`
+	Event string                 `json:"event"`
+	Route string                 `json:"route,omitempty"`
+	Time  time.Time              `json:"time"`
+	Data  map[string]interface{} `json:"data,omitempty"`
+}
+
+var webhooks []Webhook
+var webhookClient = &http.Client{Timeout: WEBHOOK_TIMEOUT}
+
+// webhookBackoff is the wait before the first retry of a delivery, it doubles
+// with every attempt
+var webhookBackoff = time.Second
+
+// lengths of the queues at the last tick of runWebhooks
+var watchedLengths = make(map[string]int)
+
+func initWebhooks(configured []Webhook) {
+	for _, webhook := range configured {
+		target, err := url.Parse(webhook.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			log.Printf("ignoring webhook with invalid url %s\n", webhook.URL)
+			continue
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+	go runWebhooks()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (webhook Webhook) wants(event WebhookEvent) bool {
+	if len(webhook.EVENTS) > 0 && !contains(webhook.EVENTS, event.Event) && event.Event != EVENT_WEBHOOK_PING {
+		return false
+	}
+	return len(webhook.ROUTES) == 0 || event.Route == "" || contains(webhook.ROUTES, event.Route)
+}
+
+// webhookSignature is the hex HMAC-SHA256 of timestamp "." body, receivers
+// recompute it with their secret and reject old timestamps
+func webhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// fireWebhook notifies the webhooks subscribed to an event of a route, the
+// deliveries run in the background
+func fireWebhook(event string, name string, data map[string]interface{}) {
+	if len(webhooks) == 0 {
+		return
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	payload := WebhookEvent{
+		ID:    hex.EncodeToString(id),
+		Event: event,
+		Route: name,
+		Time:  time.Now().UTC(),
+		Data:  data,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("Error encoding webhook event:", err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		if webhook.wants(payload) {
+			go deliverWebhook(webhook, payload, body)
+		}
+	}
+}
+
+// deliverWebhook posts an event until the endpoint answers 2xx, network
+// errors, 429 and 5xx are retried with an exponential backoff
+func deliverWebhook(webhook Webhook, event WebhookEvent, body []byte) {
+	backoff := webhookBackoff
+	for attempt := 1; attempt <= WEBHOOK_ATTEMPTS; attempt++ {
+		retry, err := postWebhook(webhook, event, body)
+		if err == nil {
+			return
+		}
+		log.Printf("webhook %s of %s to %s failed (attempt %d): %v\n", event.ID, event.Event, webhook.URL, attempt, err)
+		if !retry {
+			return
+		}
+		if attempt < WEBHOOK_ATTEMPTS {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	log.Printf("giving up webhook %s of %s to %s\n", event.ID, event.Event, webhook.URL)
+}
+
+func postWebhook(webhook Webhook, event WebhookEvent, body []byte) (bool, error) {
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WEBHOOK_EVENT_HEADER, event.Event)
+	request.Header.Set(WEBHOOK_DELIVERY_HEADER, event.ID)
+	request.Header.Set(WEBHOOK_TIME_HEADER, timestamp)
+	if webhook.SECRET != "" {
+		request.Header.Set(WEBHOOK_SIGNATURE, webhookSignature(webhook.SECRET, timestamp, body))
+	}
+
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return true, err
+	}
+	response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+	retry := response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+	return retry, fmt.Errorf("status %d", response.StatusCode)
+}
+
+// runWebhooks watches the queue lengths for the queue events, a threshold
+// fires once per crossing
+func runWebhooks() {
+	ticker := time.NewTicker(WEBHOOK_TICK)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		roomMutex.Lock()
+		for name, route := range routes {
+			length := queueLength(name)
+			previous, exists := watchedLengths[name]
+			watchedLengths[name] = length
+			if !exists || previous == length {
+				continue
+			}
+
+			data := map[string]interface{}{"queue": length, "previous": previous}
+			if previous == 0 {
+				fireWebhook(EVENT_QUEUE_STARTED, name, data)
+			} else if length == 0 {
+				fireWebhook(EVENT_QUEUE_CLEARED, name, data)
+			}
+
+			threshold := route.QUEUE_THRESHOLD
+			if threshold <= 0 {
+				continue
+			}
+			data["threshold"] = threshold
+			if previous < threshold && length >= threshold {
+				fireWebhook(EVENT_QUEUE_ABOVE, name, data)
+			} else if previous >= threshold && length < threshold {
+				fireWebhook(EVENT_QUEUE_BELOW, name, data)
+			}
+		}
+		for name := range watchedLengths {
+			if _, exists := routes[name]; !exists {
+				delete(watchedLengths, name)
+			}
+		}
+		roomMutex.Unlock()
+	}
+}
+
+// routeStateEvent is the webhook event of a route entering a state
+func routeStateEvent(previous string, state string) string {
+	if previous == state {
+		return ""
+	}
+	switch state {
+	case ROUTE_PAUSED:
+		return EVENT_ROUTE_PAUSED
+	case ROUTE_DRAINING:
+		return EVENT_ROUTE_DRAINING
+	case ROUTE_DISABLED:
+		return EVENT_ROUTE_DISABLED
+	case ROUTE_ACTIVE:
+		return EVENT_ROUTE_RESUMED
+	}
+	return ""
+}
+
+// pingWebhooks serves POST /api/v1/webhooks/ping, every webhook gets a test
+// event so that receivers can check their signature verification
+func pingWebhooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(webhooks) == 0 {
+		http.Error(w, "No webhook configured", http.StatusNotFound)
+		return
+	}
+
+	fireWebhook(EVENT_WEBHOOK_PING, "", nil)
+	writeJSON(w, http.StatusAccepted, ResponseBody{
+		Status:  "success",
+		Message: fmt.Sprintf("Pinged %d webhooks", len(webhooks)),
+	})
+}
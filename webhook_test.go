@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the deliveries it gets and answers with the given
+// status codes, the last one repeating
+type webhookReceiver struct {
+	mutex    sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (receiver *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	status := receiver.statuses[len(receiver.statuses)-1]
+	if len(receiver.requests) < len(receiver.statuses) {
+		status = receiver.statuses[len(receiver.requests)]
+	}
+	receiver.requests = append(receiver.requests, r)
+	receiver.bodies = append(receiver.bodies, body)
+	w.WriteHeader(status)
+}
+
+func (receiver *webhookReceiver) attempts() int {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	return len(receiver.requests)
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) (*webhookReceiver, Webhook) {
+	receiver := &webhookReceiver{statuses: statuses}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	previous := webhookBackoff
+	webhookBackoff = time.Millisecond
+	t.Cleanup(func() {
+		webhookBackoff = previous
+	})
+	return receiver, Webhook{URL: server.URL, SECRET: "secret"}
+}
+
+func testEvent(t *testing.T) (WebhookEvent, []byte) {
+	event := WebhookEvent{ID: "0123456789abcdef", Event: EVENT_QUEUE_STARTED, Route: "shop", Time: time.Now().UTC()}
+	body, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event, body
+}
+
+func TestWebhookSignature(t *testing.T) {
+	receiver, webhook := newWebhookReceiver(t, http.StatusOK)
+	event, body := testEvent(t)
+
+	deliverWebhook(webhook, event, body)
+
+	if receiver.attempts() != 1 {
+		t.Fatalf("got %d deliveries, want 1", receiver.attempts())
+	}
+	request := receiver.requests[0]
+	timestamp := request.Header.Get(WEBHOOK_TIME_HEADER)
+	if want := webhookSignature("secret", timestamp, receiver.bodies[0]); request.Header.Get(WEBHOOK_SIGNATURE) != want {
+		t.Errorf("signature %q, want %q", request.Header.Get(WEBHOOK_SIGNATURE), want)
+	}
+	if webhookSignature("other", timestamp, receiver.bodies[0]) == request.Header.Get(WEBHOOK_SIGNATURE) {
+		t.Error("signature does not depend on the secret")
+	}
+	if request.Header.Get(WEBHOOK_EVENT_HEADER) != EVENT_QUEUE_STARTED || request.Header.Get(WEBHOOK_DELIVERY_HEADER) != event.ID {
+		t.Errorf("event headers %q %q", request.Header.Get(WEBHOOK_EVENT_HEADER), request.Header.Get(WEBHOOK_DELIVERY_HEADER))
+	}
+	if string(receiver.bodies[0]) != string(body) {
+		t.Errorf("body %s, want %s", receiver.bodies[0], body)
+	}
+}
+
+func TestWebhookUnsigned(t *testing.T) {
+	receiver, webhook := newWebhookReceiver(t, http.StatusOK)
+	webhook.SECRET = ""
+	event, body := testEvent(t)
+
+	deliverWebhook(webhook, event, body)
+
+	if receiver.requests[0].Header.Get(WEBHOOK_SIGNATURE) != "" {
+		t.Error("webhook without secret is signed")
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int
+	}{
+		{"success", []int{http.StatusNoContent}, 1},
+		{"server error then success", []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}, 3},
+		{"too many requests then success", []int{http.StatusTooManyRequests, http.StatusOK}, 2},
+		{"server error until giving up", []int{http.StatusServiceUnavailable}, WEBHOOK_ATTEMPTS},
+		{"client error", []int{http.StatusBadRequest}, 1},
+		{"not found", []int{http.StatusNotFound}, 1},
+		{"client error after server error", []int{http.StatusInternalServerError, http.StatusUnauthorized, http.StatusOK}, 2},
+	}
+	for _, test := range tests {
+		receiver, webhook := newWebhookReceiver(t, test.statuses...)
+		event, body := testEvent(t)
+
+		deliverWebhook(webhook, event, body)
+
+		if receiver.attempts() != test.attempts {
+			t.Errorf("%s: got %d attempts, want %d", test.name, receiver.attempts(), test.attempts)
+		}
+	}
+}
+
+func TestWebhookWants(t *testing.T) {
+	tests := []struct {
+		name    string
+		webhook Webhook
+		event   WebhookEvent
+		want    bool
+	}{
+		{"everything", Webhook{}, WebhookEvent{Event: EVENT_ROUTE_PAUSED, Route: "shop"}, true},
+		{"subscribed event", Webhook{EVENTS: []string{EVENT_ROUTE_PAUSED}}, WebhookEvent{Event: EVENT_ROUTE_PAUSED, Route: "shop"}, true},
+		{"other event", Webhook{EVENTS: []string{EVENT_ROUTE_PAUSED}}, WebhookEvent{Event: EVENT_QUEUE_STARTED, Route: "shop"}, false},
+		{"subscribed route", Webhook{ROUTES: []string{"shop"}}, WebhookEvent{Event: EVENT_QUEUE_STARTED, Route: "shop"}, true},
+		{"other route", Webhook{ROUTES: []string{"shop"}}, WebhookEvent{Event: EVENT_QUEUE_STARTED, Route: "blog"}, false},
+		{"event and route", Webhook{EVENTS: []string{EVENT_QUEUE_STARTED}, ROUTES: []string{"shop"}}, WebhookEvent{Event: EVENT_QUEUE_STARTED, Route: "blog"}, false},
+		{"ping", Webhook{EVENTS: []string{EVENT_ROUTE_PAUSED}, ROUTES: []string{"shop"}}, WebhookEvent{Event: EVENT_WEBHOOK_PING}, true},
+	}
+	for _, test := range tests {
+		if got := test.webhook.wants(test.event); got != test.want {
+			t.Errorf("%s: wants() = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFireWebhookFilters(t *testing.T) {
+	shop, shopWebhook := newWebhookReceiver(t, http.StatusOK)
+	shopWebhook.ROUTES = []string{"shop"}
+	paused, pausedWebhook := newWebhookReceiver(t, http.StatusOK)
+	pausedWebhook.EVENTS = []string{EVENT_ROUTE_PAUSED}
+
+	previous := webhooks
+	webhooks = []Webhook{shopWebhook, pausedWebhook}
+	t.Cleanup(func() {
+		webhooks = previous
+	})
+
+	fireWebhook(EVENT_QUEUE_STARTED, "shop", nil)
+	fireWebhook(EVENT_ROUTE_PAUSED, "blog", nil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for (shop.attempts() < 1 || paused.attempts() < 1) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if shop.attempts() != 1 || shop.requests[0].Header.Get(WEBHOOK_EVENT_HEADER) != EVENT_QUEUE_STARTED {
+		t.Errorf("route webhook got %d deliveries, want the queue event only", shop.attempts())
+	}
+	if paused.attempts() != 1 || paused.requests[0].Header.Get(WEBHOOK_EVENT_HEADER) != EVENT_ROUTE_PAUSED {
+		t.Errorf("event webhook got %d deliveries, want the pause event only", paused.attempts())
+	}
+}
+
+func TestRouteStateEvent(t *testing.T) {
+	tests := []struct {
+		previous string
+		state    string
+		want     string
+	}{
+		{ROUTE_ACTIVE, ROUTE_PAUSED, EVENT_ROUTE_PAUSED},
+		{ROUTE_PAUSED, ROUTE_ACTIVE, EVENT_ROUTE_RESUMED},
+		{ROUTE_ACTIVE, ROUTE_DRAINING, EVENT_ROUTE_DRAINING},
+		{ROUTE_DRAINING, ROUTE_DISABLED, EVENT_ROUTE_DISABLED},
+		{ROUTE_PAUSED, ROUTE_PAUSED, ""},
+	}
+	for _, test := range tests {
+		if got := routeStateEvent(test.previous, test.state); got != test.want {
+			t.Errorf("routeStateEvent(%s, %s) = %q, want %q", test.previous, test.state, got, test.want)
+		}
+	}
+}